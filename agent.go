@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newSessionAgent creates an in-process agent holding only the key the host authenticates with
+// so hosts the agent is forwarded to can't sign with the server's other keys.
+// The key's certificate is added as a separate identity so the plain key remains available.
+func newSessionAgent(auth SshAuth) (agent.Agent, error) {
+	var pemBytes []byte
+	var cert *ssh.Certificate
+	var sshDir string
+	var err error
+
+	switch auth.Method {
+	case "key":
+		if pemBytes, err = readPrivateKey(auth.Key); err != nil {
+			return nil, err
+		}
+
+		if sshDir, err = getSshDir(); err != nil {
+			return nil, err
+		}
+
+		if cert, err = loadCertificate(sshDir, auth.Key); err != nil {
+			return nil, err
+		}
+	case "upload":
+		pemBytes = []byte(auth.Key)
+
+		if strings.TrimSpace(auth.Certificate) != "" {
+			if cert, err = parseCertificate([]byte(auth.Certificate)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("the session isn't authenticated with a key")
+	}
+
+	privateKey, err := parseRawPrivateKey(pemBytes, auth.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := agent.NewKeyring()
+
+	addedKey := agent.AddedKey{
+		PrivateKey: privateKey,
+		Comment:    auth.Key,
+	}
+
+	if auth.Method == "upload" {
+		addedKey.Comment = "uploaded key"
+	}
+
+	if err = keyring.Add(addedKey); err != nil {
+		return nil, fmt.Errorf("agent add: %w", err)
+	}
+
+	if cert != nil {
+		addedKey.Certificate = cert
+
+		if err = keyring.Add(addedKey); err != nil {
+			return nil, fmt.Errorf("agent add cert: %w", err)
+		}
+	}
+
+	return keyring, nil
+}
+
+// forwardAgent forwards an agent holding the session's key onto the session.
+func forwardAgent(client *ssh.Client, session *ssh.Session, auth SshAuth) error {
+	keyring, err := newSessionAgent(auth)
+	if err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+
+	if err = agent.ForwardToAgent(client, keyring); err != nil {
+		return fmt.Errorf("forward agent: %w", err)
+	}
+
+	if err = agent.RequestAgentForwarding(session); err != nil {
+		return fmt.Errorf("request agent forwarding: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sammy-t/ts-term/internal/audit"
+	ws "github.com/sammy-t/ts-term/internal/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxKeySize is the largest file considered when looking for private keys.
+const maxKeySize int64 = 64 * 1024
+
+type sshPrompt struct {
+	Host        string           `json:"host"`
+	Name        string           `json:"name"`
+	Instruction string           `json:"instruction"`
+	Questions   []promptQuestion `json:"questions"`
+}
+
+type promptQuestion struct {
+	Question string `json:"question"`
+	Echo     bool   `json:"echo"`
+}
+
+// getAuthMethods builds the SSH auth methods for the host's auth config.
+// Keyboard-interactive auth is always offered as a fallback
+// with its challenges relayed to the WebSocket.
+// Server keys the access policy denies aren't loaded.
+func getAuthMethods(conn ws.SessionConn, host SshHost, access *hostAccess) ([]ssh.AuthMethod, error) {
+	auth := host.Auth
+
+	var method ssh.AuthMethod
+	var password string
+
+	switch auth.Method {
+	case "password":
+		password = auth.Password
+		method = ssh.Password(password)
+	case "prompt":
+		method = ssh.PasswordCallback(getPasswordPrompt(conn, host.HostPort(), host.User))
+	case "key":
+		if err := access.CheckKey(host, auth.Key); err != nil {
+			auditLog.Log(audit.Event{
+				Type:    audit.EventAccessDenied,
+				Session: conn.Session,
+				User:    access.User,
+				Host:    host.HostPort(),
+				SshUser: host.User,
+				Error:   err.Error(),
+			})
+
+			return nil, err
+		}
+
+		signers, err := loadPrivateKey(auth.Key, auth.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		method = ssh.PublicKeys(signers...)
+	case "upload":
+		signer, err := parsePrivateKey([]byte(auth.Key), auth.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		signers := []ssh.Signer{signer}
+
+		if strings.TrimSpace(auth.Certificate) != "" {
+			cert, err := parseCertificate([]byte(auth.Certificate))
+			if err != nil {
+				return nil, err
+			}
+
+			if signers, err = withCertificate(signer, cert); err != nil {
+				return nil, err
+			}
+		}
+
+		method = ssh.PublicKeys(signers...)
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", auth.Method)
+	}
+
+	challenge := getKeyboardInteractive(conn, host.HostPort(), password)
+
+	return []ssh.AuthMethod{method, ssh.KeyboardInteractive(challenge)}, nil
+}
+
+// getPasswordPrompt returns a callback which prompts the user for the password.
+func getPasswordPrompt(conn ws.SessionConn, hostname string, user string) func() (string, error) {
+	cb := func() (string, error) {
+		prompt := sshPrompt{
+			Host: hostname,
+			Name: "Password",
+			Questions: []promptQuestion{
+				{Question: fmt.Sprintf("%v's password:", user)},
+			},
+		}
+
+		answers, err := promptUser(conn, prompt)
+		if err != nil {
+			return "", err
+		}
+
+		return answers[0], nil
+	}
+
+	return cb
+}
+
+// getKeyboardInteractive returns a challenge handler which forwards
+// the server's questions to the WebSocket and awaits the answers.
+//
+// If a password is provided, it's used to answer the first lone password question
+// so PAM setups prompting for the password before a second factor
+// don't ask for it twice.
+func getKeyboardInteractive(conn ws.SessionConn, hostname string, password string) ssh.KeyboardInteractiveChallenge {
+	passwordUsed := password == ""
+
+	cb := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			// Some servers send challenges without questions to display info
+			if instruction != "" {
+				wsMsg := ws.Message{
+					Type: ws.MessageInfo,
+					Data: instruction,
+				}
+
+				if err := conn.WriteJSON(wsMsg); err != nil {
+					return nil, fmt.Errorf("ws write: %w", err)
+				}
+			}
+
+			return []string{}, nil
+		}
+
+		if !passwordUsed && len(questions) == 1 && !echos[0] &&
+			strings.HasPrefix(strings.ToLower(strings.TrimSpace(questions[0])), "password") {
+			passwordUsed = true
+			return []string{password}, nil
+		}
+
+		prompt := sshPrompt{
+			Host:        hostname,
+			Name:        name,
+			Instruction: instruction,
+			Questions:   []promptQuestion{},
+		}
+
+		for i, question := range questions {
+			prompt.Questions = append(prompt.Questions, promptQuestion{
+				Question: question,
+				Echo:     echos[i],
+			})
+		}
+
+		return promptUser(conn, prompt)
+	}
+
+	return cb
+}
+
+// promptUser sends the prompt to the WebSocket and awaits the answers.
+func promptUser(conn ws.SessionConn, prompt sshPrompt) ([]string, error) {
+	promptBytes, err := json.Marshal(prompt)
+	if err != nil {
+		return nil, fmt.Errorf("prompt marshal: %w", err)
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSshPrompt,
+		Data: string(promptBytes),
+	}
+
+	// Notify the user
+	if err = conn.WriteJSON(wsMsg); err != nil {
+		return nil, fmt.Errorf("ws write: %w", err)
+	}
+
+	// Await a response. Allow time for out of band factors like push notifications.
+	respMsg, err := conn.AwaitMsg(ws.MessageSshPromptAct, 3*time.Minute)
+	if err != nil {
+		log.Printf("prompt await msg: %v", err)
+		return nil, errors.New("prompt await msg error")
+	}
+
+	if respMsg.Data == "" {
+		return nil, errors.New("prompt canceled")
+	}
+
+	var answers []string
+
+	if err = json.Unmarshal([]byte(respMsg.Data), &answers); err != nil {
+		return nil, fmt.Errorf("prompt answers: %w", err)
+	}
+
+	if len(answers) != len(prompt.Questions) {
+		return nil, fmt.Errorf("prompt answers: expected %v, received %v", len(prompt.Questions), len(answers))
+	}
+
+	return answers, nil
+}
+
+// loadPrivateKey loads the named private key from the ssh directory.
+// If the key has a matching certificate, the certificate signer is
+// returned before the plain key signer.
+func loadPrivateKey(name string, passphrase string) ([]ssh.Signer, error) {
+	pemBytes, err := readPrivateKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := parsePrivateKey(pemBytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	sshDir, err := getSshDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := loadCertificate(sshDir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert == nil {
+		return []ssh.Signer{signer}, nil
+	}
+
+	return withCertificate(signer, cert)
+}
+
+// readPrivateKey reads the named private key from the ssh directory.
+func readPrivateKey(name string) ([]byte, error) {
+	sshDir, err := getSshDir()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := listPrivateKeys(sshDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only allow keys we'd list to the user.
+	// This also prevents reading files outside the ssh directory.
+	if !slices.Contains(keys, name) {
+		return nil, fmt.Errorf("key %q not found", name)
+	}
+
+	return os.ReadFile(filepath.Join(sshDir, name))
+}
+
+// loadCertificate loads the certificate for the named private key
+// following the OpenSSH `<key>-cert.pub` naming convention.
+// A nil certificate is returned if the key doesn't have one.
+func loadCertificate(sshDir string, name string) (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(filepath.Join(sshDir, name+"-cert.pub"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return parseCertificate(certBytes)
+}
+
+// parseCertificate parses a certificate in the authorized_keys format.
+func parseCertificate(certBytes []byte) (*ssh.Certificate, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse cert: %w", err)
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("parse cert: not a certificate")
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("parse cert: not a user certificate")
+	}
+
+	return cert, nil
+}
+
+// withCertificate returns a certificate signer followed by the plain signer
+// so the plain key remains available as a fallback.
+func withCertificate(signer ssh.Signer, cert *ssh.Certificate) ([]ssh.Signer, error) {
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("cert signer: %w", err)
+	}
+
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// parsePrivateKey parses the PEM encoded private key,
+// decrypting it with the passphrase if the key is protected.
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+
+	var missingErr *ssh.PassphraseMissingError
+
+	if errors.As(err, &missingErr) {
+		if passphrase == "" {
+			return nil, errors.New("key is passphrase protected")
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+
+	return signer, nil
+}
+
+// parseRawPrivateKey parses the PEM encoded private key for an agent,
+// decrypting it with the passphrase if the key is protected.
+func parseRawPrivateKey(pemBytes []byte, passphrase string) (any, error) {
+	privateKey, err := ssh.ParseRawPrivateKey(pemBytes)
+
+	var missingErr *ssh.PassphraseMissingError
+
+	if errors.As(err, &missingErr) {
+		if passphrase == "" {
+			return nil, errors.New("key is passphrase protected")
+		}
+
+		privateKey, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+
+	return privateKey, nil
+}
+
+// listPrivateKeys returns the names of the files in the directory
+// which contain a private key.
+func listPrivateKeys(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	keys := []string{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, ".pub") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.Size() > maxKeySize {
+			continue
+		}
+
+		pemBytes, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		_, err = ssh.ParseRawPrivateKey(pemBytes)
+
+		var missingErr *ssh.PassphraseMissingError
+
+		if err == nil || errors.As(err, &missingErr) {
+			keys = append(keys, name)
+		}
+	}
+
+	return keys, nil
+}
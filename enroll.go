@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/tsnet"
+)
+
+// authKeyExpiry is how long an auth key minted for a node is valid.
+// The key only needs to outlive the node's startup.
+const authKeyExpiry time.Duration = 5 * time.Minute
+
+// defaultApiUrl is the Tailscale API used to mint auth keys when TS_TERM_API_URL isn't set.
+const defaultApiUrl string = "https://api.tailscale.com"
+
+// enroller logs nodes in to the tailnet without a user following the login URL.
+//
+// Nodes log in with the configured auth key
+// or a single-use, pre-authorized auth key minted with the OAuth client for each node.
+// A nil enroller leaves nodes to log in interactively.
+type enroller struct {
+	authKey string
+	oauth   *clientcredentials.Config
+	apiUrl  string
+	tags    []string
+}
+
+// newEnroller configures node enrollment from TS_TERM_AUTHKEY, TS_TERM_OAUTH_CLIENT_SECRET
+// or their files and the TS_TERM_TAGS advertised by the nodes.
+// It returns nil if neither is set.
+func newEnroller() (*enroller, error) {
+	authKey, err := getSecret("TS_TERM_AUTHKEY")
+	if err != nil {
+		return nil, fmt.Errorf("auth key: %w", err)
+	}
+
+	clientSecret, err := getSecret("TS_TERM_OAUTH_CLIENT_SECRET")
+	if err != nil {
+		return nil, fmt.Errorf("oauth client secret: %w", err)
+	}
+
+	if authKey == "" && clientSecret == "" {
+		return nil, nil
+	}
+
+	if authKey != "" && clientSecret != "" {
+		return nil, errors.New("set either an auth key or an oauth client secret")
+	}
+
+	e := &enroller{
+		authKey: authKey,
+		tags:    getTags(),
+	}
+
+	if clientSecret == "" {
+		return e, nil
+	}
+
+	// Keys minted by an OAuth client must be owned by tags
+	if len(e.tags) == 0 {
+		return nil, errors.New("oauth client requires TS_TERM_TAGS")
+	}
+
+	e.apiUrl = os.Getenv("TS_TERM_API_URL")
+	if e.apiUrl == "" {
+		e.apiUrl = defaultApiUrl
+	}
+
+	e.oauth = &clientcredentials.Config{
+		// Tailscale identifies the client by its secret
+		ClientID:     "ts-term",
+		ClientSecret: clientSecret,
+		TokenURL:     e.apiUrl + "/api/v2/oauth/token",
+	}
+
+	return e, nil
+}
+
+// Configure sets the node's auth key and advertised tags.
+// An auth key is minted for the node if enrolling with the OAuth client.
+func (e *enroller) Configure(ctx context.Context, server *tsnet.Server) error {
+	if e == nil {
+		return nil
+	}
+
+	server.AdvertiseTags = e.tags
+
+	if e.oauth == nil {
+		server.AuthKey = e.authKey
+		return nil
+	}
+
+	authKey, err := e.mintAuthKey(ctx, server.Ephemeral)
+	if err != nil {
+		return fmt.Errorf("mint auth key: %w", err)
+	}
+
+	server.AuthKey = authKey
+
+	return nil
+}
+
+// mintAuthKey creates a single-use, pre-authorized auth key for the tags with the Tailscale API.
+func (e *enroller) mintAuthKey(ctx context.Context, ephemeral bool) (string, error) {
+	keyReq := map[string]any{
+		"capabilities": map[string]any{
+			"devices": map[string]any{
+				"create": map[string]any{
+					"reusable":      false,
+					"ephemeral":     ephemeral,
+					"preauthorized": true,
+					"tags":          e.tags,
+				},
+			},
+		},
+		"expirySeconds": int64(authKeyExpiry.Seconds()),
+		"description":   "ts-term node",
+	}
+
+	reqBytes, err := json.Marshal(keyReq)
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.apiUrl+"/api/v2/tailnet/-/keys", bytes.NewReader(reqBytes))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.oauth.Client(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("read: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(respBytes)))
+	}
+
+	var key struct {
+		Key string `json:"key"`
+	}
+
+	if err = json.Unmarshal(respBytes, &key); err != nil {
+		return "", fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return key.Key, nil
+}
+
+// getSecret returns the secret in the env var
+// or read from the file in the env var with the `_FILE` suffix. ex. A Docker secret
+func getSecret(name string) (string, error) {
+	if secret := os.Getenv(name); secret != "" {
+		return secret, nil
+	}
+
+	secretPath := os.Getenv(name + "_FILE")
+	if secretPath == "" {
+		return "", nil
+	}
+
+	secretBytes, err := os.ReadFile(secretPath)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(secretBytes)), nil
+}
+
+// getTags returns the comma separated TS_TERM_TAGS advertised by the nodes.
+// ex. 'tag:ts-term,tag:ssh'
+func getTags() []string {
+	var tags []string
+
+	for tag := range strings.SplitSeq(os.Getenv("TS_TERM_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/sammy-t/ts-term/internal/audit"
+	ws "github.com/sammy-t/ts-term/internal/websocket"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/tsnet"
+)
+
+// PortForward describes a port forwarded between the tailnet and the SSH host.
+//
+// Local forwards listen on the Tailscale node and dial the target from the SSH host.
+// Remote forwards listen on the SSH host and dial the target through the tailnet.
+type PortForward struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Port is the listening port.
+	// A remote forward requesting port 0 is bound to any available port.
+	Port int `json:"port"`
+	// Address is the address of the listening port.
+	Address string `json:"address"`
+	// Target is the address dialed for each accepted connection.
+	Target string `json:"target"`
+}
+
+type activeForward struct {
+	PortForward
+	listener net.Listener
+}
+
+// forwarder manages the port forwards of an SSH client
+// and reports changes to the WebSocket.
+//
+// Remote forwards' targets are checked against the access policy
+// since they're dialed through the tailnet.
+type forwarder struct {
+	server    *tsnet.Server
+	sshClient *ssh.Client
+	conn      msgWriter
+	access    *hostAccess
+	// session is the ID of the session the forwards belong to.
+	session  string
+	forwards []*activeForward
+	mu       *sync.Mutex
+}
+
+func newForwarder(server *tsnet.Server, sshClient *ssh.Client, conn msgWriter, access *hostAccess, session string) *forwarder {
+	return &forwarder{
+		server:    server,
+		sshClient: sshClient,
+		conn:      conn,
+		access:    access,
+		session:   session,
+		forwards:  []*activeForward{},
+		mu:        &sync.Mutex{},
+	}
+}
+
+// HandleMsg adds or removes forwards as requested by the message
+// and writes the updated forwards to the WebSocket.
+func (f *forwarder) HandleMsg(msg ws.Message) {
+	var err error
+
+	switch msg.Type {
+	case ws.MessageForwardAdd:
+		var fwd PortForward
+
+		if err = json.Unmarshal([]byte(msg.Data), &fwd); err != nil {
+			break
+		}
+
+		switch fwd.Type {
+		case "local":
+			err = f.AddLocal(fwd.Port, fwd.Target)
+		case "remote":
+			err = f.AddRemote(fwd.Port, fwd.Target)
+		default:
+			err = fmt.Errorf("unknown forward type %q", fwd.Type)
+		}
+	case ws.MessageForwardRemove:
+		err = f.Remove(msg.Data)
+	default:
+		err = fmt.Errorf("unexpected msg %q", msg.Type)
+	}
+
+	if err != nil {
+		log.Printf("forward: %v", err)
+
+		wsMsg := ws.Message{
+			Type: ws.MessageInfo,
+			Data: fmt.Sprintf("Port forward failed: %v", err),
+		}
+
+		if err = f.conn.WriteJSON(wsMsg); err != nil {
+			log.Printf("ws write: %v", err)
+		}
+	}
+
+	if err = f.writeForwards(); err != nil {
+		log.Printf("ws write forwards: %v", err)
+	}
+}
+
+// AddLocal listens on the port of the Tailscale node and forwards
+// accepted connections to the target address through the SSH host.
+func (f *forwarder) AddLocal(port int, target string) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %v must be between 1 and 65535", port)
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("target %q: %w", target, err)
+	}
+
+	listener, err := f.server.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("ts listen: %w", err)
+	}
+
+	fwd := PortForward{
+		Type:    "local",
+		Port:    port,
+		Address: fmt.Sprintf("%v:%d", f.server.Hostname, port),
+		Target:  target,
+	}
+
+	dial := func() (net.Conn, error) {
+		return f.sshClient.Dial("tcp", target)
+	}
+
+	f.add(fwd, listener, dial)
+
+	return nil
+}
+
+// AddRemote requests the SSH host to listen on the port of its loopback interface
+// and forwards accepted connections to the target address through the tailnet.
+func (f *forwarder) AddRemote(port int, target string) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port %v must be between 0 and 65535", port)
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return fmt.Errorf("target %q: %w", target, err)
+	}
+
+	if err := f.access.CheckTarget(target); err != nil {
+		auditLog.Log(audit.Event{
+			Type:    audit.EventAccessDenied,
+			Session: f.session,
+			User:    f.access.User,
+			Target:  target,
+			Error:   err.Error(),
+		})
+
+		return err
+	}
+
+	listener, err := f.sshClient.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return fmt.Errorf("ssh listen: %w", err)
+	}
+
+	// Report the port the SSH host bound
+	// since it's chosen by the host when requesting port 0.
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+
+	fwd := PortForward{
+		Type:    "remote",
+		Port:    port,
+		Address: listener.Addr().String(),
+		Target:  target,
+	}
+
+	dial := func() (net.Conn, error) {
+		return f.server.Dial(context.Background(), "tcp", target)
+	}
+
+	f.add(fwd, listener, dial)
+
+	return nil
+}
+
+// add tracks the forward and starts accepting its connections.
+func (f *forwarder) add(fwd PortForward, listener net.Listener, dial func() (net.Conn, error)) {
+	fwd.ID = uuid.NewString()
+
+	f.mu.Lock()
+	f.forwards = append(f.forwards, &activeForward{PortForward: fwd, listener: listener})
+	f.mu.Unlock()
+
+	log.Printf("Forwarding %v %v to %v", fwd.Type, fwd.Address, fwd.Target)
+
+	go acceptForwards(listener, dial)
+}
+
+// Remove closes the forward with the matching ID.
+func (f *forwarder) Remove(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	idx := slices.IndexFunc(f.forwards, func(fwd *activeForward) bool {
+		return fwd.ID == id
+	})
+
+	if idx < 0 {
+		return fmt.Errorf("forward %q not found", id)
+	}
+
+	fwd := f.forwards[idx]
+	f.forwards = slices.Delete(f.forwards, idx, idx+1)
+
+	log.Printf("Removing %v forward %v to %v", fwd.Type, fwd.Address, fwd.Target)
+
+	return fwd.listener.Close()
+}
+
+// List returns the active forwards.
+func (f *forwarder) List() []PortForward {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	forwards := []PortForward{}
+
+	for _, fwd := range f.forwards {
+		forwards = append(forwards, fwd.PortForward)
+	}
+
+	return forwards
+}
+
+// Close closes all forwards.
+func (f *forwarder) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fwd := range f.forwards {
+		fwd.listener.Close()
+	}
+
+	f.forwards = []*activeForward{}
+}
+
+func (f *forwarder) writeForwards() error {
+	fwdBytes, err := json.Marshal(f.List())
+	if err != nil {
+		return err
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageForwards,
+		Data: string(fwdBytes),
+	}
+
+	return f.conn.WriteJSON(wsMsg)
+}
+
+// acceptForwards accepts connections on the listener until it's closed
+// and pipes each connection to a connection from dial.
+func acceptForwards(listener net.Listener, dial func() (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("forward accept: %v", err)
+			return
+		}
+
+		go func() {
+			target, err := dial()
+			if err != nil {
+				log.Printf("forward dial: %v", err)
+				conn.Close()
+				return
+			}
+
+			pipeConns(conn, target)
+		}()
+	}
+}
+
+// pipeConns copies data between the connections until either is done
+// then closes both connections.
+func pipeConns(a net.Conn, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventNodeCreated  EventType = "node-created"
+	EventNodeClosed   EventType = "node-closed"
+	EventConnect      EventType = "connect"
+	EventHostKey      EventType = "host-key"
+	EventAuthSuccess  EventType = "auth-success"
+	EventAuthFailure  EventType = "auth-failure"
+	EventAccessDenied EventType = "access-denied"
+	EventSessionStart EventType = "session-start"
+	EventSessionEnd   EventType = "session-end"
+	EventShareView    EventType = "share-view"
+	EventControl      EventType = "control"
+)
+
+// Event is an entry of the audit log.
+// Only the fields relevant to the event's type are set.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    EventType `json:"type"`
+	Node    string    `json:"node,omitempty"`
+	Session string    `json:"session,omitempty"`
+	// User is the login name of the Tailscale user.
+	User string `json:"user,omitempty"`
+	// UserNode is the name of the Tailscale user's machine.
+	UserNode string `json:"userNode,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	// Host is the SSH host's address. ex. 'host:22'
+	Host    string `json:"host,omitempty"`
+	SshUser string `json:"sshUser,omitempty"`
+	// Decision is the outcome of a host key check or control change.
+	Decision    string `json:"decision,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Target is the user affected by the event. ex. The viewer granted control.
+	Target     string `json:"target,omitempty"`
+	ExitStatus *int   `json:"exitStatus,omitempty"`
+	BytesIn    int64  `json:"bytesIn,omitempty"`
+	BytesOut   int64  `json:"bytesOut,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Sink receives the audit log's JSON lines.
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// Logger writes events to its sink as JSON lines.
+// A nil Logger discards the events.
+type Logger struct {
+	sink Sink
+	mu   *sync.Mutex
+}
+
+func New(sink Sink) *Logger {
+	return &Logger{
+		sink: sink,
+		mu:   &sync.Mutex{},
+	}
+}
+
+// Log writes the event, timestamped now if it has no time.
+// Failures are written to the standard log so they don't interrupt the caller.
+func (l *Logger) Log(event Event) {
+	if l == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("audit marshal: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.sink.Write(append(line, '\n')); err != nil {
+		log.Printf("audit write: %v", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sink.Close()
+}
+
+// ErrString returns the error's message or an empty string if there's no error.
+func ErrString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writerSink writes the lines to a writer.
+type writerSink struct {
+	w io.Writer
+}
+
+func (s writerSink) Write(line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s writerSink) Close() error {
+	if closer, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// NewStdoutSink creates a sink writing to stdout.
+func NewStdoutSink() Sink {
+	return writerSink{w: os.Stdout}
+}
+
+// NewFileSink creates a sink appending to the file at the path.
+func NewFileSink(path string) (Sink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return writerSink{w: file}, nil
+}
+
+// Open creates the sink described by the spec.
+// The spec is `stdout`, `syslog` or the absolute path of a file.
+func Open(spec string) (Sink, error) {
+	switch spec {
+	case "stdout":
+		return NewStdoutSink(), nil
+	case "syslog":
+		return NewSyslogSink("ts-term")
+	}
+
+	if !filepath.IsAbs(spec) {
+		return nil, fmt.Errorf("audit sink %q must be stdout, syslog or an absolute file path", spec)
+	}
+
+	return NewFileSink(spec)
+}
+
+// trimLine removes the line's trailing newline for sinks which delimit lines themselves.
+func trimLine(line []byte) string {
+	return strings.TrimSuffix(string(line), "\n")
+}
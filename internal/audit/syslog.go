@@ -0,0 +1,32 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// syslogSink writes the lines to the local syslog daemon.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s syslogSink) Write(line []byte) error {
+	return s.w.Info(trimLine(line))
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// NewSyslogSink creates a sink writing to the local syslog socket
+// with the auth facility.
+func NewSyslogSink(tag string) (Sink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, fmt.Errorf("syslog: %w", err)
+	}
+
+	return syslogSink{w: w}, nil
+}
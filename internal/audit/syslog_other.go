@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package audit
+
+import "errors"
+
+// NewSyslogSink is unsupported on platforms without a local syslog socket.
+func NewSyslogSink(tag string) (Sink, error) {
+	return nil, errors.New("syslog is unsupported on this platform")
+}
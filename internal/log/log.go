@@ -33,15 +33,21 @@ func (c ConnLog) Printf(format string, v ...any) {
 // LessFatalf writes the error to the log and WebSocket.
 // Then closes the WebSocket and net listener.
 func (c ConnLog) LessFatalf(format string, v ...any) {
+	c.Closef(websocket.CloseGoingAway, format, v...)
+
+	if err := c.Listener.Close(); err != nil {
+		log.Printf("connlog listener close: %v", err)
+	}
+}
+
+// Closef writes the error to the log and closes the WebSocket with the close code.
+// The net listener is left open.
+func (c ConnLog) Closef(code int, format string, v ...any) {
 	log.Printf(format, v...)
 
-	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, fmt.Sprintf(format, v...))
+	msg := websocket.FormatCloseMessage(code, fmt.Sprintf(format, v...))
 
 	if err := c.Conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
 		log.Printf("connlog close: %v", err)
 	}
-
-	if err := c.Listener.Close(); err != nil {
-		log.Printf("connlog listener close: %v", err)
-	}
 }
@@ -12,20 +12,35 @@
 type Hub struct {
 	Conn      *SyncedWebsocket
 	Closed    chan int
-	listeners map[MessageType][]chan msgResp
+	listeners map[listenerKey][]chan msgResp
+	handler   func(msg Message)
 	mu        *sync.Mutex
 }
 
+// listenerKey identifies the listeners of a message type.
+// Listeners without a session receive the messages of every session.
+type listenerKey struct {
+	msgType MessageType
+	session string
+}
+
 type msgResp struct {
 	msg Message
 	err error
 }
 
 func NewHub(conn *SyncedWebsocket) Hub {
+	return NewHandlerHub(conn, nil)
+}
+
+// NewHandlerHub creates a Hub which passes the messages
+// without a registered listener to the handler.
+func NewHandlerHub(conn *SyncedWebsocket, handler func(msg Message)) Hub {
 	h := Hub{
 		Conn:      conn,
 		Closed:    make(chan int),
-		listeners: make(map[MessageType][]chan msgResp),
+		listeners: make(map[listenerKey][]chan msgResp),
+		handler:   handler,
 		mu:        &sync.Mutex{},
 	}
 
@@ -35,7 +50,7 @@ func NewHub(conn *SyncedWebsocket) Hub {
 }
 
 func (h Hub) listen() {
-	defer func() { h.Closed <- 0 }()
+	defer close(h.Closed)
 
 	readLimit := 60 * time.Second
 
@@ -57,11 +72,19 @@ func (h Hub) listen() {
 }
 
 func (h Hub) AwaitMsg(msgType MessageType, timeout time.Duration) (Message, error) {
+	return h.AwaitSessionMsg(msgType, "", timeout)
+}
+
+// AwaitSessionMsg awaits a message of the type belonging to the session.
+// An empty session awaits the message from any session.
+func (h Hub) AwaitSessionMsg(msgType MessageType, session string, timeout time.Duration) (Message, error) {
 	var msg Message
 	var err error
 
-	ch := h.registerListener(msgType)
-	defer h.unregisterListener(msgType, ch)
+	key := listenerKey{msgType: msgType, session: session}
+
+	ch := h.registerListener(key)
+	defer h.unregisterListener(key, ch)
 
 	go func() {
 		if timeout.Milliseconds() == 0 {
@@ -74,7 +97,7 @@ func (h Hub) AwaitMsg(msgType MessageType, timeout time.Duration) (Message, erro
 			return
 		}
 
-		ch <- msgResp{err: fmt.Errorf("await msg %q timed out", msgType)}
+		notify(ch, msgResp{err: fmt.Errorf("await msg %q timed out", msgType)})
 	}()
 
 	select {
@@ -95,70 +118,98 @@ func (h Hub) readMessages() error {
 		return err
 	}
 
-	log.Printf("hub msg: %q", msg.Type)
-
 	switch msg.Type {
 	case MessageError, MessageSshErr, MessageWsError:
+		log.Printf("hub msg: %q", msg.Type)
+
 		// Create an error response
 		resp := msgResp{
 			msg: msg,
 			err: errors.New(string(msg.Type)),
 		}
 
-		// Notify all listeners
-		for _, channels := range h.getAllListeners() {
-			for _, respChan := range channels {
-				respChan <- resp
-			}
+		channels := h.getListeners(msg, true)
+
+		// Notify all listeners of the session
+		for _, ch := range channels {
+			notify(ch, resp)
+		}
+
+		if len(channels) == 0 && h.handler != nil {
+			h.handler(msg)
 		}
 		return nil
 	}
 
-	channels, ok := h.getListeners(msg.Type)
-	if !ok {
+	channels := h.getListeners(msg, false)
+
+	if len(channels) == 0 {
+		if h.handler != nil {
+			h.handler(msg)
+		}
 		return nil
 	}
 
+	log.Printf("hub msg: %q", msg.Type)
+
 	// Notify listeners registered for the message type
 	for _, ch := range channels {
-		ch <- msgResp{msg: msg, err: nil}
+		notify(ch, msgResp{msg: msg, err: nil})
 	}
 
 	return nil
 }
 
-func (h Hub) registerListener(msgType MessageType) chan msgResp {
+func (h Hub) registerListener(key listenerKey) chan msgResp {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	ch := make(chan msgResp)
+	// Buffer the response so notifying a listener
+	// which is no longer waiting doesn't block the hub.
+	ch := make(chan msgResp, 1)
 
-	h.listeners[msgType] = append(h.listeners[msgType], ch)
+	h.listeners[key] = append(h.listeners[key], ch)
 
 	return ch
 }
 
-func (h Hub) unregisterListener(msgType MessageType, ch chan msgResp) {
+func (h Hub) unregisterListener(key listenerKey, ch chan msgResp) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	h.listeners[msgType] = slices.DeleteFunc(h.listeners[msgType], func(channel chan msgResp) bool {
+	h.listeners[key] = slices.DeleteFunc(h.listeners[key], func(channel chan msgResp) bool {
 		return channel == ch
 	})
 }
 
-func (h Hub) getAllListeners() map[MessageType][]chan msgResp {
+// getListeners returns the listeners registered for the message's type and session.
+// If allTypes is true, the listeners of every message type are returned.
+func (h Hub) getListeners(msg Message, allTypes bool) []chan msgResp {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	return h.listeners
-}
+	channels := []chan msgResp{}
 
-func (h Hub) getListeners(msgType MessageType) ([]chan msgResp, bool) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	for key, keyChannels := range h.listeners {
+		if !allTypes && key.msgType != msg.Type {
+			continue
+		}
 
-	channels, ok := h.listeners[msgType]
+		if key.session != "" && msg.Session != "" && key.session != msg.Session {
+			continue
+		}
+
+		channels = append(channels, keyChannels...)
+	}
 
-	return channels, ok
+	return channels
+}
+
+// notify sends the response to the listener
+// unless the listener already has a pending response.
+func notify(ch chan msgResp, resp msgResp) {
+	select {
+	case ch <- resp:
+	default:
+	}
 }
@@ -3,22 +3,55 @@
 type MessageType string
 
 const (
-	MessageInfo       MessageType = "info"
-	MessagePeers      MessageType = "peers"
-	MessageSshCfg     MessageType = "ssh-config"
-	MessageSshHost    MessageType = "ssh-host"
-	MessageSshHostAct MessageType = "ssh-host-action"
-	MessageSshErr     MessageType = "ssh-error"
-	MessageSshSuccess MessageType = "ssh-success"
-	MessageWsOpened   MessageType = "ts-websocket-opened"
-	MessageWsError    MessageType = "ts-websocket-error"
-	MessageSize       MessageType = "size"
-	MessageInput      MessageType = "input"
-	MessageOutput     MessageType = "output"
-	MessageError      MessageType = "error"
+	MessageInfo           MessageType = "info"
+	MessagePeers          MessageType = "peers"
+	MessagePeerAdd        MessageType = "peer-add"
+	MessagePeerUpdate     MessageType = "peer-update"
+	MessagePeerRemove     MessageType = "peer-remove"
+	MessageSshCfg         MessageType = "ssh-config"
+	MessageSshKeys        MessageType = "ssh-keys"
+	MessageSshHost        MessageType = "ssh-host"
+	MessageSshHostAct     MessageType = "ssh-host-action"
+	MessageSshPrompt      MessageType = "ssh-prompt"
+	MessageSshPromptAct   MessageType = "ssh-prompt-action"
+	MessageSshErr         MessageType = "ssh-error"
+	MessageSshSuccess     MessageType = "ssh-success"
+	MessageWsOpened       MessageType = "ts-websocket-opened"
+	MessageWsError        MessageType = "ts-websocket-error"
+	MessageSize           MessageType = "size"
+	MessageSessionOpen    MessageType = "session-open"
+	MessageSessionClose   MessageType = "session-close"
+	MessageSessionClosed  MessageType = "session-closed"
+	MessageSessionToken   MessageType = "session-token"
+	MessageSessionResume  MessageType = "session-resume"
+	MessageSessionAttach  MessageType = "session-attach"
+	MessageSessionDetach  MessageType = "session-detach"
+	MessageSessionShare   MessageType = "session-share"
+	MessageSessionUnshare MessageType = "session-unshare"
+	MessageSessionViewers MessageType = "session-viewers"
+	MessageSessionControl MessageType = "session-control"
+	MessageNodeInfo       MessageType = "node-info"
+	MessageNodeForget     MessageType = "node-forget"
+	MessageForwards       MessageType = "forwards"
+	MessageForwardAdd     MessageType = "forward-add"
+	MessageForwardRemove  MessageType = "forward-remove"
+	MessageSftpList       MessageType = "sftp-list"
+	MessageSftpDownload   MessageType = "sftp-download"
+	MessageSftpUpload     MessageType = "sftp-upload"
+	MessageSftpChunk      MessageType = "sftp-chunk"
+	MessageSftpProgress   MessageType = "sftp-progress"
+	MessageSftpDone       MessageType = "sftp-done"
+	MessageSftpCancel     MessageType = "sftp-cancel"
+	MessageSftpError      MessageType = "sftp-error"
+	MessageInput          MessageType = "input"
+	MessageOutput         MessageType = "output"
+	MessageError          MessageType = "error"
 )
 
 type Message struct {
 	Type MessageType `json:"type"`
 	Data string      `json:"data"`
+	// Session is the ID of the session the message belongs to
+	// when multiple sessions share the WebSocket.
+	Session string `json:"session,omitempty"`
 }
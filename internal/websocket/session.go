@@ -0,0 +1,22 @@
+package websocket
+
+import "time"
+
+// SessionConn writes and awaits the messages of one session
+// multiplexed with other sessions on the hub's WebSocket.
+type SessionConn struct {
+	Hub     Hub
+	Session string
+}
+
+// WriteJSON writes the message tagged with the session.
+func (s SessionConn) WriteJSON(msg Message) error {
+	msg.Session = s.Session
+
+	return s.Hub.Conn.WriteJSON(msg)
+}
+
+// AwaitMsg awaits a message of the type belonging to the session.
+func (s SessionConn) AwaitMsg(msgType MessageType, timeout time.Duration) (Message, error) {
+	return s.Hub.AwaitSessionMsg(msgType, s.Session, timeout)
+}
@@ -1,23 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/sammy-t/ts-term/internal/audit"
 	cnLog "github.com/sammy-t/ts-term/internal/log"
 	ws "github.com/sammy-t/ts-term/internal/websocket"
-	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/tsnet"
 )
 
@@ -30,24 +38,101 @@
 
 var dev bool
 
+// sessions tracks the sessions of every node
+// so a user's sessions can be listed and reattached from any node.
+var sessions = newSessionStore()
+
+// auditLog records the nodes, connections and sessions.
+// It's nil if the audit log is disabled.
+var auditLog *audit.Logger
+
 func init() {
 	godotenv.Load()
 
 	flag.BoolVar(&dev, "dev", false, "development mode")
-	flag.Parse()
 }
 
 func main() {
+	// Flags are parsed in main so the test binary can parse its own flags
+	flag.Parse()
+
+	auditSink, err := getAuditSink()
+	if err != nil {
+		log.Fatalf("audit: %v", err)
+	}
+
+	if auditSink != nil {
+		auditLog = audit.New(auditSink)
+	}
+
+	// main exits through log.Fatal or a signal so deferred calls don't close the audit log
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+		sig := <-sigCh
+		log.Printf("Received %v, shutting down", sig)
+
+		auditLog.Close()
+		os.Exit(0)
+	}()
+
+	// Identify the callers and the recordings' viewers with the host's Tailscale daemon
+	tsClient := &local.Client{Socket: os.Getenv("TS_TERM_TAILSCALED_SOCKET")}
+
+	enroll, err := newEnroller()
+	if err != nil {
+		log.Fatalf("enroll: %v", err)
+	}
+
+	pool, err := newNodePool(enroll)
+	if err != nil {
+		log.Fatalf("pool: %v", err)
+	}
+
+	pool.Start(context.Background())
+
+	users, err := newUserNodes()
+	if err != nil {
+		log.Fatalf("user nodes: %v", err)
+	}
+
+	var uiServer *tsnet.Server
+
+	if uiHostname := getUiHostname(); uiHostname != "" {
+		uiServer, err = startUiNode(context.Background(), uiHostname, enroll)
+		if err != nil {
+			log.Fatalf("ui node: %v", err)
+		}
+		defer uiServer.Close()
+
+		// Identify them with the UI node instead
+		tsClient, err = uiServer.LocalClient()
+		if err != nil {
+			log.Fatalf("ui node client: %v", err)
+		}
+	}
+
 	http.Handle("/", getWebHandler())
-	http.HandleFunc("/ts", tsHandler)
+	http.HandleFunc("/ts", getTsHandler(tsClient, enroll, pool, users))
+	http.HandleFunc("GET /pool", getPoolStatsHandler(pool))
+	http.HandleFunc("GET /recordings", getRecordingListHandler(tsClient))
+	http.HandleFunc("GET /recordings/{name}", getRecordingHandler(tsClient))
+
+	if uiServer != nil {
+		err = serveUiNode(uiServer, http.DefaultServeMux)
+	} else {
+		addr := os.Getenv("TS_TERM_ADDR")
+		if addr == "" {
+			addr = ":3000"
+		}
 
-	addr := os.Getenv("TS_TERM_ADDR")
-	if addr == "" {
-		addr = ":3000"
+		log.Printf("Serving ts-term on %v", addr)
+		err = http.ListenAndServe(addr, nil)
 	}
 
-	log.Printf("Serving ts-term on %v", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	auditLog.Close()
+	log.Fatal(err)
 }
 
 func getWebHandler() http.Handler {
@@ -59,163 +144,398 @@ func getWebHandler() http.Handler {
 	return http.FileServer(http.Dir("web/dist"))
 }
 
-func tsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request %q", r.URL.Path)
+// getTsHandler returns the handler of the init WebSocket
+// which creates a Tailscale node for the caller to connect through.
+//
+// Callers are identified by the host's Tailscale daemon before their node is created
+// so users the access policy denies are rejected without the node's startup.
+// Identified callers get their persistent node if user nodes are enabled.
+// Otherwise, nodes are logged in by the enroller if it's configured
+// and taken from the warm node pool when one is ready.
+func getTsHandler(client *local.Client, enroll *enroller, pool *nodePool, users *userNodes) http.HandlerFunc {
+	requireWhoIs := getRequireWhoIs()
 
-	wsConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Fatalf("Websocket: %v", err)
-	}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received request %q", r.URL.Path)
 
-	conn := &ws.SyncedWebsocket{
-		Conn: wsConn,
-		Mu:   &sync.Mutex{},
-	}
-	defer conn.Close()
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Fatalf("Websocket: %v", err)
+		}
 
-	hub := ws.NewHub(conn)
+		conn := &ws.SyncedWebsocket{
+			Conn: wsConn,
+			Mu:   &sync.Mutex{},
+		}
+		defer conn.Close()
 
-	hostname := createHostName()
+		who, err := identifyCaller(r, client, requireWhoIs)
+		if err != nil {
+			log.Printf("caller %v: %v", r.RemoteAddr, err)
 
-	dir, err := os.MkdirTemp("", "tsnet-"+hostname)
-	if err != nil {
-		log.Fatalf("mkdir: %v\n", err)
-	}
-	defer os.RemoveAll(dir)
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			conn.WriteMessage(websocket.CloseMessage, closeMsg)
+			return
+		}
 
-	controlUrl := os.Getenv("TS_CONTROL_URL")
+		hub := ws.NewHub(conn)
 
-	server := &tsnet.Server{
-		Hostname:   hostname,
-		Dir:        dir,
-		Ephemeral:  true,
-		ControlURL: controlUrl,
-	}
-	defer server.Close()
+		node, err := openNode(r.Context(), who, enroll, pool, users)
+		if err != nil {
+			log.Printf("ts node: %v", err)
+			return
+		}
+		defer node.Close()
 
-	var listener net.Listener
+		server := node.server
+		hostname := server.Hostname
 
-	log.Printf("Creating tsnet server %q...", hostname)
+		var listener net.Listener
 
-	if strings.HasPrefix(r.Header["Origin"][0], "https:") {
-		log.Println("Enabling tsnet TLS. HTTPS Certificates must be enabled in the admin panel for this to work.")
+		if strings.HasPrefix(r.Header["Origin"][0], "https:") {
+			log.Println("Enabling tsnet TLS. HTTPS Certificates must be enabled in the admin panel for this to work.")
 
-		listener, err = server.ListenTLS("tcp", ":443")
-	} else {
-		listener, err = server.Listen("tcp", ":80")
-	}
+			listener, err = server.ListenTLS("tcp", ":443")
+		} else {
+			listener, err = server.Listen("tcp", ":80")
+		}
 
-	if err != nil {
-		log.Printf("ts listener: %v", err)
-		return
-	}
-	defer listener.Close()
+		if err != nil {
+			log.Printf("ts listener: %v", err)
+			return
+		}
+		defer listener.Close()
 
-	log.Println("Getting local client...")
-	client, err := server.LocalClient()
-	if err != nil {
-		log.Printf("ts client: %v", err)
-		return
-	}
+		log.Println("Getting local client...")
+		client, err := server.LocalClient()
+		if err != nil {
+			log.Printf("ts client: %v", err)
+			return
+		}
 
-	log.Println("Starting ping...")
-	ws.PingConn(conn, 3*time.Second)
+		log.Println("Starting ping...")
+		ws.PingConn(conn, 3*time.Second)
 
-	log.Println("Polling status...")
-	if err := pollStatus(r, server, client, &hub); err != nil {
-		log.Printf("poll status: %v", err)
-		return
-	}
+		log.Println("Polling status...")
+		if err := pollStatus(r, server, client, &hub); err != nil {
+			log.Printf("poll status: %v", err)
+			return
+		}
 
-	log.Println("Getting peer conn info...")
-	peerInfos, err := getPeerConnInfo(r, client)
-	if err != nil {
-		log.Printf("peer info: %v", err)
-		return
+		auditLog.Log(audit.Event{
+			Type: audit.EventNodeCreated,
+			Node: hostname,
+		})
+		defer auditLog.Log(audit.Event{
+			Type: audit.EventNodeClosed,
+			Node: hostname,
+		})
+
+		log.Println("Getting peer conn info...")
+		peerInfos, err := getPeerConnInfo(r, server, client)
+		if err != nil {
+			log.Printf("peer info: %v", err)
+			return
+		}
+
+		infoBytes, err := json.Marshal(peerInfos)
+		if err != nil {
+			log.Printf("peer marshal: %v", err)
+			return
+		}
+
+		wsMsg := ws.Message{
+			Type: ws.MessagePeers,
+			Data: string(infoBytes),
+		}
+
+		log.Println("Sending peer info...")
+		if err := conn.WriteJSON(wsMsg); err != nil {
+			log.Printf("ws write peers: %v", err)
+			return
+		}
+
+		log.Println("Getting ssh keys...")
+		sshDir, err := getSshDir()
+		if err != nil {
+			log.Printf("ssh dir: %v", err)
+			return
+		}
+
+		keys, err := listPrivateKeys(sshDir)
+		if err != nil {
+			log.Printf("ssh keys: %v", err)
+			return
+		}
+
+		keyBytes, err := json.Marshal(keys)
+		if err != nil {
+			log.Printf("keys marshal: %v", err)
+			return
+		}
+
+		wsMsg = ws.Message{
+			Type: ws.MessageSshKeys,
+			Data: string(keyBytes),
+		}
+
+		log.Println("Sending ssh keys...")
+		if err := conn.WriteJSON(wsMsg); err != nil {
+			log.Printf("ws write keys: %v", err)
+			return
+		}
+
+		log.Println("Awaiting ssh config...")
+		cfgMsg, err := awaitSshConfig(&hub)
+		if err != nil {
+			log.Printf("%v await ssh cfg: %v", hostname, err)
+			return
+		}
+
+		log.Println("Awaiting ts websocket opened msg...")
+		go func() {
+			defer conn.Close()
+
+			// Await the ts-websocket-opened message
+			_, err := hub.AwaitMsg(ws.MessageWsOpened, 30*time.Second)
+			if err != nil {
+				log.Printf("%v websocket await: %v", hostname, err)
+				listener.Close()
+				return
+			}
+
+			log.Printf("%v websocket connected to client.", hostname)
+		}()
+
+		log.Printf("Running %v server", hostname)
+
+		err = http.Serve(listener, getTsServerHandler(listener, node, client, who, cfgMsg))
+		log.Printf("%v server closed: %v", hostname, err)
 	}
 
-	infoBytes, err := json.Marshal(peerInfos)
+	return h
+}
+
+// identifyCaller identifies the init WebSocket's caller with the host's Tailscale daemon
+// and returns an error if the access policy file denies the caller.
+//
+// Callers the daemon can't identify (ex. when ts-term's port is published from a container)
+// are left to be identified by their node unless identifying them is required.
+// The caller is nil if they're unidentified.
+func identifyCaller(r *http.Request, client *local.Client, required bool) (*apitype.WhoIsResponse, error) {
+	who, err := client.WhoIs(r.Context(), r.RemoteAddr)
 	if err != nil {
-		log.Printf("peer marshal: %v", err)
-		return
-	}
+		if required {
+			return nil, errors.New("unknown tailscale user")
+		}
 
-	wsMsg := ws.Message{
-		Type: ws.MessagePeers,
-		Data: string(infoBytes),
+		log.Printf("ts who %v: %v. The caller will be identified by their node.", r.RemoteAddr, err)
+		return nil, nil
 	}
 
-	log.Println("Sending peer info...")
-	if err := conn.WriteJSON(wsMsg); err != nil {
-		log.Printf("ws write peers: %v", err)
-		return
+	auditLog.Log(audit.Event{
+		Type:     audit.EventConnect,
+		User:     who.UserProfile.LoginName,
+		UserNode: who.Node.ComputedName,
+		Remote:   r.RemoteAddr,
+	})
+
+	// Grants are checked by the node since the host's capabilities are granted for the host
+	// rather than the ts-term nodes in the grants' dst
+	if os.Getenv("TS_TERM_POLICY") != policyGrants {
+		if _, err = getHostAccess(who); err != nil {
+			auditLog.Log(audit.Event{
+				Type:     audit.EventAccessDenied,
+				User:     who.UserProfile.LoginName,
+				UserNode: who.Node.ComputedName,
+				Error:    err.Error(),
+			})
+
+			log.Printf("access %q: %v", who.UserProfile.LoginName, err)
+			return nil, fmt.Errorf("access denied for %v", who.UserProfile.LoginName)
+		}
 	}
 
-	log.Println("Awaiting ssh config...")
-	// Await the ssh config info
-	respMsg, err := hub.AwaitMsg(ws.MessageSshCfg, 10*time.Minute)
-	if err != nil {
-		log.Printf("%v await ssh cfg: %v", hostname, err)
-		return
+	log.Printf("Identified caller %q from %v", who.UserProfile.LoginName, who.Node.ComputedName)
+
+	return who, nil
+}
+
+// openNode returns the node for the caller's connection.
+//
+// Identified callers get their persistent node unless it's serving another connection.
+// Otherwise, a warm node is taken from the pool if one is ready
+// or a new ephemeral node is created.
+func openNode(ctx context.Context, who *apitype.WhoIsResponse, enroll *enroller, pool *nodePool, users *userNodes) (*tsNode, error) {
+	if who != nil {
+		node, err := users.Open(who)
+		if err != nil {
+			return nil, fmt.Errorf("user node: %w", err)
+		}
+
+		if node != nil {
+			log.Printf("Using %q's node %q", node.owner, node.server.Hostname)
+			return node, nil
+		}
 	}
 
-	sshCfg := parseSshConfig(respMsg.Data)
+	// Skip the node's startup with a warm node if one is ready
+	if node, ok := pool.Take(); ok {
+		log.Printf("Using warm node %q", node.server.Hostname)
+		return node, nil
+	}
 
-	log.Println("Awaiting ts websocket opened msg...")
-	go func() {
-		defer conn.Close()
+	return newEphemeralNode(ctx, enroll)
+}
 
-		// Await the ts-websocket-opened message
-		_, err := hub.AwaitMsg(ws.MessageWsOpened, 30*time.Second)
+// awaitSshConfig awaits a valid ssh-config message from the hub's WebSocket.
+// Invalid configs are reported to the user who can then resend the config.
+func awaitSshConfig(hub *ws.Hub) (ws.Message, error) {
+	for {
+		// Await the ssh config info
+		respMsg, err := hub.AwaitMsg(ws.MessageSshCfg, 10*time.Minute)
 		if err != nil {
-			log.Printf("%v websocket await: %v", hostname, err)
-			listener.Close()
-			return
+			return respMsg, err
 		}
 
-		log.Printf("%v websocket connected to client.", hostname)
-	}()
+		_, err = parseSshConfig(respMsg.Data)
+		if err == nil {
+			return respMsg, nil
+		}
 
-	log.Printf("Running %v server", hostname)
+		log.Printf("ssh config: %v", err)
+
+		conn := ws.SessionConn{
+			Hub:     *hub,
+			Session: respMsg.Session,
+		}
 
-	err = http.Serve(listener, getTsServerHandler(listener, server, client, sshCfg))
-	log.Printf("%v server closed: %v", hostname, err)
+		if err = writeSshErr(conn, err); err != nil {
+			return respMsg, err
+		}
+	}
 }
 
-func getTsServerHandler(listener net.Listener, server *tsnet.Server, client *local.Client, sshCfg map[string]string) http.Handler {
+// getTsServerHandler returns the handler of the Tailscale node.
+//
+// The terminal WebSocket multiplexes the node's SSH sessions.
+// The first session connects using the ssh-config message received on the init WebSocket
+// and the browser can open additional sessions over the running node with session-open messages.
+//
+// Sessions are disconnected when their WebSocket closes and a reconnecting browser
+// can resume them with session-resume messages until the resume grace expires.
+// Sessions detached with session-detach messages keep running
+// and the owner can attach them from any node with session-attach messages.
+//
+// The node closes once it neither runs a session nor serves a session's WebSocket.
+//
+// The initial session's config comes from the init WebSocket's caller
+// so only they may use the node if they were identified.
+func getTsServerHandler(listener net.Listener, node *tsNode, client *local.Client, caller *apitype.WhoIsResponse, cfgMsg ws.Message) http.Handler {
+	server := node.server
 	tsUpgrader := createUpgraderTs(client)
 
+	resumeGrace := getResumeGrace()
+
+	var initOnce sync.Once
+
+	// initialized is whether the node opened its initial session.
+	// From then on, the node is closed once it's idle.
+	var initialized atomic.Bool
+
 	h := func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Received request %v %q", server.Hostname, r.URL.Path)
 
+		// The init WebSocket closes the node if the browser's WebSocket doesn't open
 		wsConn, err := tsUpgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("Websocket: %v", err)
-			listener.Close()
 			return
 		}
 
 		// Wrap the WebSocket in a sync helper
-		// since both PTY 'read' and 'error' write to the WebSocket.
+		// since the sessions' PTY 'read' and 'error' write to the WebSocket.
 		conn := &ws.SyncedWebsocket{
 			Conn: wsConn,
 			Mu:   &sync.Mutex{},
 		}
+		defer conn.Close()
 
 		cLog := cnLog.ConnLog{
 			Conn:     conn,
 			Listener: listener,
 		}
 
+		// fail closes the WebSocket after a failure and keeps the node's sessions
+		// for the browser's other WebSockets.
+		// Before the node's initial session is opened, nothing else would close the node so it's closed as well.
+		fail := func(format string, v ...any) {
+			if initialized.Load() {
+				cLog.Closef(websocket.CloseInternalServerErr, format, v...)
+				return
+			}
+
+			cLog.LessFatalf(format, v...)
+		}
+
 		status, err := client.Status(r.Context())
 		if err != nil {
-			cLog.LessFatalf("ts status: %v", err)
+			fail("ts status: %v", err)
 			return
 		}
 
 		who, err := client.WhoIs(r.Context(), r.RemoteAddr)
 		if err != nil {
-			cLog.LessFatalf("ts who: %v", err)
+			fail("ts who: %v", err)
+			return
+		}
+
+		auditLog.Log(audit.Event{
+			Type:     audit.EventConnect,
+			Node:     server.Hostname,
+			User:     who.UserProfile.LoginName,
+			UserNode: who.Node.ComputedName,
+			Remote:   r.RemoteAddr,
+		})
+
+		if !node.Allows(who.UserProfile.LoginName) {
+			auditLog.Log(audit.Event{
+				Type:     audit.EventAccessDenied,
+				Node:     server.Hostname,
+				User:     who.UserProfile.LoginName,
+				UserNode: who.Node.ComputedName,
+				Error:    "not the node's owner",
+			})
+
+			cLog.Closef(websocket.ClosePolicyViolation, "access denied: %v belongs to %v", server.Hostname, node.owner)
+			return
+		}
+
+		if caller != nil && who.UserProfile.LoginName != caller.UserProfile.LoginName {
+			auditLog.Log(audit.Event{
+				Type:     audit.EventAccessDenied,
+				Node:     server.Hostname,
+				User:     who.UserProfile.LoginName,
+				UserNode: who.Node.ComputedName,
+				Error:    "not the node's caller",
+			})
+
+			cLog.Closef(websocket.ClosePolicyViolation, "access denied: %v was opened by another user", server.Hostname)
+			return
+		}
+
+		access, err := getHostAccess(who)
+		if err != nil {
+			auditLog.Log(audit.Event{
+				Type:     audit.EventAccessDenied,
+				Node:     server.Hostname,
+				User:     who.UserProfile.LoginName,
+				UserNode: who.Node.ComputedName,
+				Error:    err.Error(),
+			})
+
+			// Only the caller's WebSocket is closed so a denied caller can't close the node
+			cLog.Closef(websocket.ClosePolicyViolation, "access denied: %v", err)
 			return
 		}
 
@@ -232,7 +552,23 @@ func getTsServerHandler(listener net.Listener, server *tsnet.Server, client *loc
 		}
 
 		if err = conn.WriteJSON(wsMsg); err != nil {
-			cLog.LessFatalf("ws write: %v", err)
+			fail("ws write: %v", err)
+			return
+		}
+
+		infoBytes, err := json.Marshal(node.Info())
+		if err != nil {
+			fail("node info marshal: %v", err)
+			return
+		}
+
+		wsMsg = ws.Message{
+			Type: ws.MessageNodeInfo,
+			Data: string(infoBytes),
+		}
+
+		if err = conn.WriteJSON(wsMsg); err != nil {
+			fail("ws write: %v", err)
 			return
 		}
 
@@ -240,122 +576,341 @@ func getTsServerHandler(listener net.Listener, server *tsnet.Server, client *loc
 		if knownHostsPath == "" {
 			knownHostsPath, err = getKnownHostsPath()
 			if err != nil {
-				cLog.LessFatalf("known hosts path: %v", err)
+				fail("known hosts path: %v", err)
 				return
 			}
 		}
 
-		hostKeyCb := getHostKeyCallback(conn, knownHostsPath)
+		hostCAPath := os.Getenv("TS_TERM_HOST_CA_KEYS")
 
-		config := &ssh.ClientConfig{
-			User: sshCfg["username"],
-			Auth: []ssh.AuthMethod{
-				ssh.Password(sshCfg["password"]),
-			},
-			HostKeyCallback: hostKeyCb,
-		}
+		// Messages without a listener are routed to the sessions from this handler
+		msgCh := make(chan ws.Message)
 
-		// Connect to the address through the tailnet
-		tsConn, err := server.Dial(r.Context(), "tcp", sshCfg["address"])
-		if err != nil {
-			cLog.LessFatalf("ts dial: %v", err)
-			return
-		}
+		hub := ws.NewHandlerHub(conn, func(msg ws.Message) { msgCh <- msg })
 
-		// Create an SSH connection using the tailnet connection
-		sshConn, newChan, reqs, err := ssh.NewClientConn(tsConn, sshCfg["address"], config)
-		if err != nil {
-			cLog.Printf("ssh conn: %v", err)
-			sshConn, newChan, reqs, err = reattemptSSH(r, server, conn, config)
-		}
-		// Return if reattempts fail
-		if err != nil {
-			log.Printf("ssh conn: %v", err)
-			cLog.LessFatalf("ssh failed")
-			return
-		}
+		ws.PingConn(conn, 3*time.Second)
 
-		wsMsg = ws.Message{
-			Type: ws.MessageSshSuccess,
-		}
+		// Keep the browser's machine list current while the WebSocket is open
+		peersCtx, cancelPeers := context.WithCancel(r.Context())
+		defer cancelPeers()
 
-		if err = conn.WriteJSON(wsMsg); err != nil {
-			cLog.LessFatalf("ws write: %v", err)
-			return
-		}
+		go func() {
+			if err := watchPeers(peersCtx, server, client, conn); err != nil {
+				log.Printf("%v watch peers: %v", server.Hostname, err)
+			}
+		}()
 
-		sshClient := ssh.NewClient(sshConn, newChan, reqs)
-		defer sshClient.Close()
+		openSession := func(id string, cfgData string) {
+			sConn := ws.SessionConn{
+				Hub:     hub,
+				Session: id,
+			}
 
-		session, err := sshClient.NewSession()
-		if err != nil {
-			cLog.LessFatalf("sess: %v", err)
-			return
+			sess := newTermSession(id, who.UserProfile.LoginName, server.Hostname, sConn)
+
+			if err := sessions.Add(sess); err != nil {
+				log.Printf("session: %v", err)
+				sess.Close()
+				writeSessionClosed(sConn, err)
+				return
+			}
+
+			log.Printf("Opening session %v", id)
+
+			go func() {
+				hostKeyCb := getHostKeyCallback(sConn, knownHostsPath, hostCAPath)
+
+				err := sess.Run(r.Context(), server, hostKeyCb, access, cfgData)
+				if err != nil {
+					log.Printf("session %v: %v", id, err)
+				}
+
+				sess.Close()
+				sessions.Remove(id)
+
+				log.Printf("Closed session %v", id)
+				writeSessionClosed(sess, err)
+
+				sessions.CloseIdleNodes()
+			}()
 		}
-		defer session.Close()
 
-		modes := ssh.TerminalModes{
-			ssh.ECHO:          1,     // enable echoing
-			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+		resumeSession := func(id string, token string) {
+			sConn := ws.SessionConn{
+				Hub:     hub,
+				Session: id,
+			}
+
+			sess, ok := sessions.Get(id)
+			if !ok {
+				writeSessionClosed(sConn, fmt.Errorf("session %q not found", id))
+				return
+			}
+
+			if err := sess.Resume(sConn, server.Hostname, who.UserProfile.LoginName, token); err != nil {
+				log.Printf("resume %v: %v", id, err)
+				writeSessionClosed(sConn, fmt.Errorf("resume failed: %w", err))
+				return
+			}
+
+			log.Printf("Resumed session %v", id)
 		}
 
-		// Request a PTY on the SSH session with an arbitrary height and width.
-		// The frontend will send updated height and width once it's connected.
-		if err = session.RequestPty("xterm-256color", 40, 80, modes); err != nil {
-			cLog.LessFatalf("req pty: %v", err)
-			return
+		attachSession := func(id string) {
+			sConn := ws.SessionConn{
+				Hub:     hub,
+				Session: id,
+			}
+
+			sess, ok := sessions.Get(id)
+			if !ok {
+				writeSessionClosed(sConn, fmt.Errorf("session %q not found", id))
+				return
+			}
+
+			if err := sess.Attach(sConn, server.Hostname, who.UserProfile.LoginName); err != nil {
+				log.Printf("attach %v: %v", id, err)
+				writeSessionClosed(sConn, fmt.Errorf("attach failed: %w", err))
+				return
+			}
+
+			log.Printf("Attached session %v to %v", id, server.Hostname)
+
+			// The node previously serving the session may be unused now
+			sessions.CloseIdleNodes()
 		}
 
-		onClosed := func() {
-			conn.Close()
-			session.Close()
+		// forgetNode logs the owner's persistent node out and closes it,
+		// ending the node's sessions. The node's state is deleted once it's closed.
+		forgetNode := func() {
+			if !node.persistent || who.UserProfile.LoginName != node.owner {
+				log.Printf("%q can't forget %v", who.UserProfile.LoginName, server.Hostname)
+				return
+			}
+
+			wsMsg := ws.Message{
+				Type: ws.MessageInfo,
+				Data: fmt.Sprintf("Forgetting %v. You'll log in again on your next connection.", server.Hostname),
+			}
+
+			conn.WriteJSON(wsMsg)
+
+			if err := node.Forget(context.Background()); err != nil {
+				log.Printf("forget %v: %v", server.Hostname, err)
+				cLog.Printf("Unable to forget %v. %v", server.Hostname, err)
+				return
+			}
+
+			log.Printf("Forgot %v", server.Hostname)
+
 			listener.Close()
 		}
 
-		errPipe, err := session.StderrPipe()
-		if err != nil {
-			log.Printf("sess err: %v", err)
-			return
-		}
+		shareSession := func(sess *termSession) {
+			token, err := sess.Share()
+			if err != nil {
+				log.Printf("share %v: %v", sess.ID, err)
+				sess.writeInfo(fmt.Sprintf("Unable to share the session. %v", err))
+				return
+			}
 
-		outPipe, err := session.StdoutPipe()
-		if err != nil {
-			log.Printf("sess out: %v", err)
-			return
+			// Viewers connect to the node running the session
+			link := shareLink{
+				Node:  sess.Node,
+				Token: token,
+			}
+
+			linkBytes, err := json.Marshal(link)
+			if err != nil {
+				log.Printf("share marshal: %v", err)
+				return
+			}
+
+			wsMsg := ws.Message{
+				Type: ws.MessageSessionShare,
+				Data: string(linkBytes),
+			}
+
+			sess.WriteJSON(wsMsg)
 		}
 
-		inPipe, err := session.StdinPipe()
-		if err != nil {
-			log.Printf("sess in: %v", err)
-			return
+		// Only the node's first WebSocket opens the session from the init WebSocket.
+		// Later WebSockets are browsers reconnecting to resume their sessions.
+		initOnce.Do(func() {
+			initSession := cfgMsg.Session
+			if initSession == "" {
+				initSession = uuid.NewString()
+			}
+
+			openSession(initSession, cfgMsg.Data)
+			initialized.Store(true)
+
+			sessions.AddNode(server.Hostname, func() {
+				log.Printf("%v has no sessions left", server.Hostname)
+				listener.Close()
+			})
+
+			// Close the node if the initial session already failed
+			sessions.CloseIdleNodes()
+		})
+
+		for {
+			select {
+			case <-hub.Closed:
+				log.Printf("%v websocket closed", server.Hostname)
+				sessions.DisconnectConn(conn, resumeGrace)
+				sessions.CloseIdleNodes()
+				return
+			case msg := <-msgCh:
+				switch msg.Type {
+				case ws.MessageSessionOpen:
+					openSession(msg.Session, msg.Data)
+					continue
+				case ws.MessageSessionResume:
+					resumeSession(msg.Session, msg.Data)
+					continue
+				case ws.MessageSessionAttach:
+					attachSession(msg.Session)
+					continue
+				case ws.MessageNodeForget:
+					forgetNode()
+					continue
+				}
+
+				sess, ok := sessions.GetConn(msg.Session, conn)
+				if !ok {
+					log.Printf("ws type: %v, unknown session %q", msg.Type, msg.Session)
+					continue
+				}
+
+				switch msg.Type {
+				case ws.MessageSessionClose:
+					sess.Close()
+					continue
+				case ws.MessageSessionDetach:
+					if err := sess.Detach(conn); err != nil {
+						log.Printf("detach %v: %v", msg.Session, err)
+						continue
+					}
+
+					sessions.CloseIdleNodes()
+					continue
+				case ws.MessageSessionShare:
+					shareSession(sess)
+					continue
+				case ws.MessageSessionUnshare:
+					sess.Unshare()
+					sess.writeInfo("Sharing stopped.")
+					continue
+				case ws.MessageSessionControl:
+					var ctrl controlMsg
+
+					if err := json.Unmarshal([]byte(msg.Data), &ctrl); err != nil {
+						log.Printf("control: %v", err)
+						continue
+					}
+
+					if err := sess.SetControl(ctrl.Viewer, ctrl.Control); err != nil {
+						log.Printf("control %v: %v", msg.Session, err)
+					}
+					continue
+				}
+
+				sess.HandleMsg(msg)
+			}
 		}
+	}
 
-		go ptyErrToWs(errPipe, conn, onClosed)
-		go ptyToWs(outPipe, conn, onClosed)
-		go wsToPty(inPipe, session, conn, onClosed)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sftp", getOwnerHandler(node, client, getSftpHandler(client, tsUpgrader, sessions)))
+	mux.HandleFunc("/sessions", getSessionsHandler(client, sessions))
+	mux.HandleFunc("/share", getOwnerHandler(node, client, getShareHandler(client, tsUpgrader, sessions)))
+	mux.HandleFunc("/", h)
 
-		if err = session.Shell(); err != nil {
-			cLog.LessFatalf("shell: %v", err)
-			return
+	return mux
+}
+
+// getSessionsHandler returns a handler listing the caller's running sessions on every node.
+// The sessions are identified by the caller's Tailscale user.
+func getSessionsHandler(client *local.Client, sessions *sessionStore) http.HandlerFunc {
+	checkOrigin := createOriginCheckTs(client)
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received sessions request %q", r.URL.Path)
+
+		// The frontend is served from another host
+		// so allow the tailnet's origins to read the list.
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !checkOrigin(r) {
+				http.Error(w, "invalid origin", http.StatusForbidden)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
 		}
 
-		// Wait for the remote command to exit.
-		// This ensures the i/o pipes stay alive while we're using them.
-		if err = session.Wait(); err != nil {
-			cLog.LessFatalf("sess wait: %v", err)
+		who, err := client.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Printf("sessions ts who: %v", err)
+			http.Error(w, "unknown tailscale user", http.StatusForbidden)
 			return
 		}
 
-		closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		w.Header().Set("Content-Type", "application/json")
 
-		if err = conn.WriteMessage(websocket.CloseMessage, closeMsg); err != nil {
-			cLog.LessFatalf("ws close: %v", err)
-			return
+		if err = json.NewEncoder(w).Encode(sessions.List(who.UserProfile.LoginName)); err != nil {
+			log.Printf("sessions write: %v", err)
 		}
+	}
+
+	return h
+}
 
-		listener.Close()
+// writeSessionClosed notifies the user the session ended
+// with the error which ended it, if any.
+func writeSessionClosed(conn msgWriter, sessErr error) {
+	msg := ws.Message{
+		Type: ws.MessageSessionClosed,
+	}
+
+	if sessErr != nil {
+		msg.Data = sessErr.Error()
+	}
+
+	if err := conn.WriteJSON(msg); err != nil {
+		log.Printf("ws write session closed: %v", err)
+	}
+}
+
+// getAuditSink returns the sink of the audit log set by TS_TERM_AUDIT
+// or nil if the audit log is disabled.
+func getAuditSink() (audit.Sink, error) {
+	spec := os.Getenv("TS_TERM_AUDIT")
+	if spec == "" {
+		return nil, nil
+	}
+
+	return audit.Open(spec)
+}
+
+// getRequireWhoIs returns whether callers must be identified by the host's Tailscale daemon
+// before a node is created for them.
+func getRequireWhoIs() bool {
+	require, err := strconv.ParseBool(os.Getenv("TS_TERM_REQUIRE_WHOIS"))
+
+	return err == nil && require
+}
+
+// getPoolStatsHandler returns a handler describing the warm node pool.
+func getPoolStatsHandler(pool *nodePool) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(pool.Stats()); err != nil {
+			log.Printf("pool stats write: %v", err)
+		}
 	}
 
-	return http.HandlerFunc(h)
+	return h
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tsnet"
+)
+
+// tsNode is the Tailscale node a connection's sessions run through.
+//
+// Ephemeral nodes keep their state in a temporary dir.
+// Persistent nodes belong to a user and keep their state between connections until they're forgotten.
+type tsNode struct {
+	server  *tsnet.Server
+	dir     string
+	created time.Time
+	// owner is the login name of the Tailscale user a persistent node belongs to.
+	owner      string
+	persistent bool
+	forgotten  atomic.Bool
+	// release frees a persistent node for the user's next connection.
+	release func()
+}
+
+// nodeInfo is the data of the node-info message.
+type nodeInfo struct {
+	Name       string `json:"name"`
+	Persistent bool   `json:"persistent"`
+}
+
+// newEphemeralNode creates an ephemeral node which isn't started yet.
+// The node is logged in by the enroller if it's configured.
+func newEphemeralNode(ctx context.Context, enroll *enroller) (*tsNode, error) {
+	hostname := createHostName()
+
+	log.Printf("Creating tsnet server %q...", hostname)
+
+	dir, err := os.MkdirTemp("", "tsnet-"+hostname)
+	if err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	server := &tsnet.Server{
+		Hostname:   hostname,
+		Dir:        dir,
+		Ephemeral:  true,
+		ControlURL: os.Getenv("TS_CONTROL_URL"),
+	}
+
+	if err = enroll.Configure(ctx, server); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+
+	node := &tsNode{
+		server:  server,
+		dir:     dir,
+		created: time.Now(),
+	}
+
+	return node, nil
+}
+
+// Forget logs the persistent node out of the tailnet
+// and deletes its state once it's closed.
+func (n *tsNode) Forget(ctx context.Context) error {
+	if !n.persistent {
+		return errors.New("the node isn't persistent")
+	}
+
+	client, err := n.server.LocalClient()
+	if err != nil {
+		return fmt.Errorf("ts client: %w", err)
+	}
+
+	if err = client.Logout(ctx); err != nil {
+		return fmt.Errorf("logout: %w", err)
+	}
+
+	n.forgotten.Store(true)
+
+	return nil
+}
+
+// Close closes the node and removes its state dir
+// unless it's a persistent node which wasn't forgotten.
+func (n *tsNode) Close() {
+	if err := n.server.Close(); err != nil {
+		log.Printf("%v close: %v", n.server.Hostname, err)
+	}
+
+	if !n.persistent || n.forgotten.Load() {
+		os.RemoveAll(n.dir)
+	}
+
+	if n.release != nil {
+		n.release()
+	}
+}
+
+// Allows returns whether the user may use the node.
+// Persistent nodes are logged in as their owner so only the owner may use them.
+func (n *tsNode) Allows(loginName string) bool {
+	return !n.persistent || loginName == n.owner
+}
+
+// Info describes the node to the browser.
+func (n *tsNode) Info() nodeInfo {
+	return nodeInfo{
+		Name:       n.server.Hostname,
+		Persistent: n.persistent,
+	}
+}
+
+// getOwnerHandler returns a handler which rejects callers other than the owner of a persistent node.
+// The tailnet attributes a persistent node's traffic to its owner.
+func getOwnerHandler(node *tsNode, client *local.Client, next http.HandlerFunc) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if !node.persistent {
+			next(w, r)
+			return
+		}
+
+		who, err := client.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Printf("owner ts who: %v", err)
+			http.Error(w, "unknown tailscale user", http.StatusForbidden)
+			return
+		}
+
+		if !node.Allows(who.UserProfile.LoginName) {
+			log.Printf("%q denied %v %q", who.UserProfile.LoginName, node.server.Hostname, r.URL.Path)
+			http.Error(w, "not the node's owner", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+
+	return h
+}
+
+// userNodes keeps a persistent node for each Tailscale user
+// so users log in once instead of for every connection.
+// The nodes' state is encrypted with the state key.
+//
+// A nil userNodes has no nodes.
+type userNodes struct {
+	dir string
+	key []byte
+	// inUse are the IDs of the users whose node is serving a connection.
+	inUse map[string]bool
+	mu    *sync.Mutex
+}
+
+// newUserNodes returns the user nodes if TS_TERM_USER_NODES is enabled.
+// The nodes require a 32 byte, base64 encoded TS_TERM_STATE_KEY.
+func newUserNodes() (*userNodes, error) {
+	enabled, err := strconv.ParseBool(os.Getenv("TS_TERM_USER_NODES"))
+	if err != nil || !enabled {
+		return nil, nil
+	}
+
+	keyStr, err := getSecret("TS_TERM_STATE_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("state key: %w", err)
+	}
+
+	if keyStr == "" {
+		return nil, errors.New("user nodes require TS_TERM_STATE_KEY")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(keyStr)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("state key must be 32 base64 encoded bytes")
+	}
+
+	dir, err := getUserNodesDir()
+	if err != nil {
+		return nil, fmt.Errorf("user nodes dir: %w", err)
+	}
+
+	u := &userNodes{
+		dir:   dir,
+		key:   key,
+		inUse: make(map[string]bool),
+		mu:    &sync.Mutex{},
+	}
+
+	return u, nil
+}
+
+// Open returns the user's persistent node which isn't started yet.
+// It returns nil if the node is serving another of the user's connections.
+func (u *userNodes) Open(who *apitype.WhoIsResponse) (*tsNode, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	id := strconv.FormatInt(int64(who.UserProfile.ID), 10)
+
+	u.mu.Lock()
+	if u.inUse[id] {
+		u.mu.Unlock()
+		return nil, nil
+	}
+
+	u.inUse[id] = true
+	u.mu.Unlock()
+
+	release := func() {
+		u.mu.Lock()
+		delete(u.inUse, id)
+		u.mu.Unlock()
+	}
+
+	dir := path.Join(u.dir, id)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		release()
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	store, err := newEncryptedStore(path.Join(dir, "tailscaled.state.enc"), u.key)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("state: %w", err)
+	}
+
+	server := &tsnet.Server{
+		Hostname:   userNodeHostname(who.UserProfile.LoginName),
+		Dir:        dir,
+		Store:      store,
+		ControlURL: os.Getenv("TS_CONTROL_URL"),
+	}
+
+	node := &tsNode{
+		server:     server,
+		dir:        dir,
+		created:    time.Now(),
+		owner:      who.UserProfile.LoginName,
+		persistent: true,
+		release:    release,
+	}
+
+	return node, nil
+}
+
+// userNodeHostname returns the name of the user's persistent node.
+// ex. 'ts-term-alice' for 'alice@example.com'
+func userNodeHostname(loginName string) string {
+	name, _, _ := strings.Cut(strings.ToLower(loginName), "@")
+
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+
+		return '-'
+	}, name)
+
+	return "ts-term-" + strings.Trim(name, "-")
+}
+
+// getUserNodesDir returns the directory the user nodes' state is kept in.
+func getUserNodesDir() (string, error) {
+	if usersDir := os.Getenv("TS_TERM_USER_NODES_DIR"); usersDir != "" {
+		return usersDir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".ts-term", "users"), nil
+}
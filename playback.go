@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// recordingInfo describes a stored recording in the recordings list.
+type recordingInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Started time.Time `json:"started"`
+	recordingMeta
+}
+
+// getRecordingListHandler returns a handler listing the recordings the caller can play back.
+// Callers are identified by the Tailscale daemon running on ts-term's host.
+func getRecordingListHandler(client *local.Client) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received recordings request %q", r.URL.Path)
+
+		who, ok := whoIsCaller(w, r, client)
+		if !ok {
+			return
+		}
+
+		recordDir, err := getRecordDir()
+		if err != nil {
+			log.Printf("record dir: %v", err)
+			http.Error(w, "recordings unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		infos, err := listRecordings(recordDir, who)
+		if err != nil {
+			log.Printf("recordings: %v", err)
+			http.Error(w, "recordings unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err = json.NewEncoder(w).Encode(infos); err != nil {
+			log.Printf("recordings write: %v", err)
+		}
+	}
+
+	return h
+}
+
+// getRecordingHandler returns a handler serving the recording file in the `name` path value.
+// Only the recording's Tailscale user and admins are allowed.
+func getRecordingHandler(client *local.Client) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received recording request %q", r.URL.Path)
+
+		who, ok := whoIsCaller(w, r, client)
+		if !ok {
+			return
+		}
+
+		name := r.PathValue("name")
+
+		if name != path.Base(name) || path.Ext(name) != ".cast" {
+			http.NotFound(w, r)
+			return
+		}
+
+		recordDir, err := getRecordDir()
+		if err != nil {
+			log.Printf("record dir: %v", err)
+			http.Error(w, "recordings unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		file, err := os.Open(path.Join(recordDir, name))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer file.Close()
+
+		header, err := readCastHeader(file)
+		if err != nil {
+			log.Printf("recording %v: %v", name, err)
+			http.NotFound(w, r)
+			return
+		}
+
+		if !canPlayBack(who, header.Metadata) {
+			log.Printf("recording %v denied %q", name, who.UserProfile.LoginName)
+			http.Error(w, "not the recording's user", http.StatusForbidden)
+			return
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			log.Printf("recording %v: %v", name, err)
+			http.Error(w, "recording unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-asciicast")
+
+		// ServeContent seeks back to the start of the file
+		http.ServeContent(w, r, name, stat.ModTime(), file)
+	}
+
+	return h
+}
+
+// whoIsCaller identifies the request's Tailscale user
+// and responds with an error if the user is unknown.
+func whoIsCaller(w http.ResponseWriter, r *http.Request, client *local.Client) (*apitype.WhoIsResponse, bool) {
+	who, err := client.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		log.Printf("ts who %v: %v", r.RemoteAddr, err)
+		http.Error(w, "unknown tailscale user", http.StatusForbidden)
+		return nil, false
+	}
+
+	return who, true
+}
+
+// listRecordings returns the recordings in the directory which the user can play back
+// from newest to oldest.
+func listRecordings(dir string, who *apitype.WhoIsResponse) ([]recordingInfo, error) {
+	infos := []recordingInfo{}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return infos, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".cast" {
+			continue
+		}
+
+		info, err := readRecordingInfo(path.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("recording %v: %v", entry.Name(), err)
+			continue
+		}
+
+		if canPlayBack(who, info.recordingMeta) {
+			infos = append(infos, info)
+		}
+	}
+
+	slices.SortFunc(infos, func(a, b recordingInfo) int {
+		return b.Started.Compare(a.Started)
+	})
+
+	return infos, nil
+}
+
+func readRecordingInfo(filePath string) (recordingInfo, error) {
+	var info recordingInfo
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+
+	header, err := readCastHeader(file)
+	if err != nil {
+		return info, err
+	}
+
+	info = recordingInfo{
+		Name:          stat.Name(),
+		Size:          stat.Size(),
+		Started:       time.Unix(header.Timestamp, 0),
+		recordingMeta: header.Metadata,
+	}
+
+	return info, nil
+}
+
+// readCastHeader reads the header line of the asciicast file.
+func readCastHeader(file *os.File) (castHeader, error) {
+	var header castHeader
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return header, fmt.Errorf("read header: %w", err)
+	}
+
+	if err = json.Unmarshal([]byte(strings.TrimSpace(line)), &header); err != nil {
+		return header, fmt.Errorf("header: %w", err)
+	}
+
+	if header.Version != 2 {
+		return header, fmt.Errorf("unsupported asciicast version %v", header.Version)
+	}
+
+	return header, nil
+}
+
+// canPlayBack reports whether the Tailscale user recorded the session
+// or is granted the admin capability.
+// The capability is granted for the machine which identified the user.
+func canPlayBack(who *apitype.WhoIsResponse, meta recordingMeta) bool {
+	if who.UserProfile.LoginName == meta.User {
+		return true
+	}
+
+	values, err := tailcfg.UnmarshalCapJSON[tsTermCapValue](who.CapMap, tsTermCap)
+	if err != nil {
+		log.Printf("ts-term cap: %v", err)
+		return false
+	}
+
+	return slices.ContainsFunc(values, func(v tsTermCapValue) bool {
+		return v.Admin
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// policyGrants is the TS_TERM_POLICY value which reads the access rules
+// from the ts-term capability granted in the tailnet policy file.
+const policyGrants string = "grants"
+
+// tsTermCap is the peer capability granting ts-term permissions in the tailnet policy file.
+// ex. `{"app": {"github.com/sammy-t/ts-term": [{"admin": true}]}}`
+const tsTermCap tailcfg.PeerCapability = "github.com/sammy-t/ts-term"
+
+// tsTermCapValue is a value of the ts-term capability.
+type tsTermCapValue struct {
+	// Admin allows playing back every user's recordings.
+	Admin bool `json:"admin"`
+	// The access rule's hosts, ports and users are allowed
+	// when the access policy uses grants. The rule's src is unused.
+	accessRule
+}
+
+// accessPolicy is the local HuJSON policy file
+// deciding which tailnet users may connect to which SSH hosts.
+type accessPolicy struct {
+	// Groups are named lists of login names. ex. `"group:admins": ["alice@example.com"]`
+	Groups map[string][]string `json:"groups"`
+	Rules  []accessRule        `json:"rules"`
+}
+
+// accessRule allows its sources to connect to its hosts' ports as its users.
+type accessRule struct {
+	// Src are the login names, group names, tags or `*` for every user the rule applies to.
+	Src []string `json:"src,omitempty"`
+	// Hosts are host name patterns, IP addresses or CIDR prefixes. ex. `*.example.com`, `100.64.0.0/10`, `*`
+	Hosts []string `json:"hosts,omitempty"`
+	// Ports are the allowed ports. Every port is allowed if empty.
+	Ports []int `json:"ports,omitempty"`
+	// Users are the allowed remote usernames or `*` for every username.
+	Users []string `json:"users,omitempty"`
+	// Keys are the server keys allowed for key auth or `*` for every key.
+	// Server keys are denied if empty.
+	Keys []string `json:"keys,omitempty"`
+	// ForwardAgent allows forwarding the session's agent to the hosts.
+	ForwardAgent bool `json:"forwardAgent,omitempty"`
+}
+
+// hostAccess is the access rules applying to a tailnet user.
+// A nil hostAccess allows every host.
+type hostAccess struct {
+	// User is the login name of the Tailscale user.
+	User  string
+	rules []accessRule
+}
+
+// getHostAccess evaluates the access policy set by TS_TERM_POLICY for the Tailscale user.
+// It returns nil if there's no policy
+// and an error if the policy doesn't allow the user any host.
+func getHostAccess(who *apitype.WhoIsResponse) (*hostAccess, error) {
+	source := os.Getenv("TS_TERM_POLICY")
+	if source == "" {
+		return nil, nil
+	}
+
+	access := &hostAccess{User: who.UserProfile.LoginName}
+
+	if source == policyGrants {
+		values, err := tailcfg.UnmarshalCapJSON[tsTermCapValue](who.CapMap, tsTermCap)
+		if err != nil {
+			return nil, fmt.Errorf("ts-term cap: %w", err)
+		}
+
+		for _, value := range values {
+			access.rules = append(access.rules, value.accessRule)
+		}
+	} else {
+		policy, err := loadAccessPolicy(source)
+		if err != nil {
+			return nil, fmt.Errorf("access policy: %w", err)
+		}
+
+		access.rules = policy.rulesFor(who)
+	}
+
+	if !slices.ContainsFunc(access.rules, accessRule.allowsAny) {
+		return nil, fmt.Errorf("%v isn't allowed to connect to any host", access.User)
+	}
+
+	return access, nil
+}
+
+// loadAccessPolicy reads the HuJSON policy file.
+// The file is read for each user so changes apply without a restart.
+func loadAccessPolicy(policyPath string) (accessPolicy, error) {
+	var policy accessPolicy
+
+	policyBytes, err := os.ReadFile(policyPath)
+	if err != nil {
+		return policy, err
+	}
+
+	policyBytes, err = hujson.Standardize(policyBytes)
+	if err != nil {
+		return policy, fmt.Errorf("parse: %w", err)
+	}
+
+	if err = json.Unmarshal(policyBytes, &policy); err != nil {
+		return policy, fmt.Errorf("parse: %w", err)
+	}
+
+	return policy, nil
+}
+
+// rulesFor returns the rules with a source matching the Tailscale user or their node's tags.
+func (p accessPolicy) rulesFor(who *apitype.WhoIsResponse) []accessRule {
+	matchesSrc := func(src string) bool {
+		switch {
+		case src == "*":
+			return true
+		case strings.HasPrefix(src, "group:"):
+			return slices.Contains(p.Groups[src], who.UserProfile.LoginName)
+		case strings.HasPrefix(src, "tag:"):
+			return who.Node != nil && slices.Contains(who.Node.Tags, src)
+		}
+
+		return src == who.UserProfile.LoginName
+	}
+
+	var rules []accessRule
+
+	for _, rule := range p.Rules {
+		if slices.ContainsFunc(rule.Src, matchesSrc) {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// Check returns an error if no rule allows connecting to the host.
+func (a *hostAccess) Check(host SshHost) error {
+	if a == nil {
+		return nil
+	}
+
+	for _, rule := range a.rules {
+		if rule.allows(host) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("access denied: %v isn't allowed to connect to %v@%v", a.User, host.User, host.HostPort())
+}
+
+// CheckKey returns an error if no rule allowing the host allows authenticating with the server key.
+func (a *hostAccess) CheckKey(host SshHost, key string) error {
+	if a == nil {
+		return nil
+	}
+
+	for _, rule := range a.rules {
+		if rule.allows(host) && (slices.Contains(rule.Keys, "*") || slices.Contains(rule.Keys, key)) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("access denied: %v isn't allowed to use the server key %q for %v@%v", a.User, key, host.User, host.HostPort())
+}
+
+// CheckAgent returns an error if no rule allowing the host allows forwarding the agent to it.
+func (a *hostAccess) CheckAgent(host SshHost) error {
+	if a == nil {
+		return nil
+	}
+
+	for _, rule := range a.rules {
+		if rule.allows(host) && rule.ForwardAgent {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("access denied: %v isn't allowed to forward the agent to %v", a.User, host.HostPort())
+}
+
+// CheckTarget returns an error if no rule allows reaching the target address. ex. A remote forward's target
+// The target is matched against the rules' hosts and ports.
+func (a *hostAccess) CheckTarget(target string) error {
+	if a == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("target %q: %w", target, err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("target %q: invalid port", target)
+	}
+
+	for _, rule := range a.rules {
+		if rule.allowsAddress(host, port) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("access denied: %v isn't allowed to reach %v", a.User, target)
+}
+
+// allowsAny reports whether the rule allows any host.
+func (r accessRule) allowsAny() bool {
+	return len(r.Hosts) > 0 && len(r.Users) > 0
+}
+
+func (r accessRule) allows(host SshHost) bool {
+	if !slices.Contains(r.Users, "*") && !slices.Contains(r.Users, host.User) {
+		return false
+	}
+
+	return r.allowsAddress(host.Address, host.Port)
+}
+
+// allowsAddress reports whether the rule allows the address's port.
+func (r accessRule) allowsAddress(address string, port int) bool {
+	if len(r.Ports) > 0 && !slices.Contains(r.Ports, port) {
+		return false
+	}
+
+	return slices.ContainsFunc(r.Hosts, func(pattern string) bool {
+		return matchHost(pattern, address)
+	})
+}
+
+// matchHost reports whether the address matches the host pattern.
+// IP addresses are matched by CIDR prefixes and host names by glob patterns.
+func matchHost(pattern string, address string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		addr, err := netip.ParseAddr(address)
+		return err == nil && prefix.Contains(addr.Unmap())
+	}
+
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(address))
+
+	return err == nil && matched
+}
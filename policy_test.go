@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		address string
+		want    bool
+	}{
+		{pattern: "*", address: "anything", want: true},
+		{pattern: "db", address: "db", want: true},
+		{pattern: "db", address: "db2", want: false},
+		{pattern: "*.example.com", address: "web.example.com", want: true},
+		{pattern: "*.example.com", address: "WEB.Example.com", want: true},
+		{pattern: "*.example.com", address: "example.com", want: false},
+		{pattern: "*.example.com", address: "web.example.com.evil", want: false},
+		{pattern: "100.64.0.0/10", address: "100.100.1.2", want: true},
+		{pattern: "100.64.0.0/10", address: "10.0.0.1", want: false},
+		{pattern: "100.64.0.0/10", address: "host", want: false},
+		{pattern: "fd7a:115c:a1e0::/48", address: "fd7a:115c:a1e0::1", want: true},
+		{pattern: "100.64.0.1/32", address: "::ffff:100.64.0.1", want: true},
+		{pattern: "[", address: "[", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.address); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestHostAccessCheck(t *testing.T) {
+	access := &hostAccess{
+		User: "alice@example.com",
+		rules: []accessRule{
+			{Hosts: []string{"*.dev.example.com"}, Ports: []int{22}, Users: []string{"*"}, ForwardAgent: true},
+			{Hosts: []string{"db"}, Users: []string{"postgres"}, Keys: []string{"id_ed25519"}},
+			{Hosts: []string{"100.64.0.0/10"}, Ports: []int{5432}, Users: []string{"admin"}, Keys: []string{"*"}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		host SshHost
+		want bool
+	}{
+		{name: "wildcard host and user", host: SshHost{User: "root", Address: "web.dev.example.com", Port: 22}, want: true},
+		{name: "port not allowed", host: SshHost{User: "root", Address: "web.dev.example.com", Port: 2222}, want: false},
+		{name: "host not allowed", host: SshHost{User: "root", Address: "web.example.com", Port: 22}, want: false},
+		{name: "every port", host: SshHost{User: "postgres", Address: "db", Port: 2222}, want: true},
+		{name: "user not allowed", host: SshHost{User: "root", Address: "db", Port: 22}, want: false},
+		{name: "cidr", host: SshHost{User: "admin", Address: "100.64.0.5", Port: 5432}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := access.Check(tt.host)
+
+			if got := err == nil; got != tt.want {
+				t.Errorf("Check(%+v) = %v, want allowed %v", tt.host, err, tt.want)
+			}
+		})
+	}
+
+	keyTests := []struct {
+		name string
+		host SshHost
+		key  string
+		want bool
+	}{
+		{name: "listed key", host: SshHost{User: "postgres", Address: "db", Port: 22}, key: "id_ed25519", want: true},
+		{name: "unlisted key", host: SshHost{User: "postgres", Address: "db", Port: 22}, key: "id_rsa", want: false},
+		{name: "every key", host: SshHost{User: "admin", Address: "100.64.0.5", Port: 5432}, key: "id_rsa", want: true},
+		{name: "rule without keys", host: SshHost{User: "root", Address: "web.dev.example.com", Port: 22}, key: "id_ed25519", want: false},
+	}
+
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := access.CheckKey(tt.host, tt.key)
+
+			if got := err == nil; got != tt.want {
+				t.Errorf("CheckKey(%+v, %q) = %v, want allowed %v", tt.host, tt.key, err, tt.want)
+			}
+		})
+	}
+
+	targetTests := []struct {
+		target string
+		want   bool
+	}{
+		{target: "web.dev.example.com:22", want: true},
+		{target: "web.dev.example.com:80", want: false},
+		{target: "db:5432", want: true},
+		{target: "100.64.0.5:5432", want: true},
+		{target: "10.0.0.1:5432", want: false},
+		{target: "db", want: false},
+		{target: "db:http", want: false},
+	}
+
+	for _, tt := range targetTests {
+		if err := access.CheckTarget(tt.target); (err == nil) != tt.want {
+			t.Errorf("CheckTarget(%q) = %v, want allowed %v", tt.target, err, tt.want)
+		}
+	}
+
+	if err := access.CheckAgent(SshHost{User: "root", Address: "web.dev.example.com", Port: 22}); err != nil {
+		t.Errorf("CheckAgent to an agent rule's host: %v", err)
+	}
+
+	if err := access.CheckAgent(SshHost{User: "postgres", Address: "db", Port: 22}); err == nil {
+		t.Error("CheckAgent to a host without an agent rule is allowed")
+	}
+}
+
+func TestHostAccessNil(t *testing.T) {
+	var access *hostAccess
+
+	host := SshHost{User: "root", Address: "anything", Port: 22}
+
+	if err := access.Check(host); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+
+	if err := access.CheckKey(host, "id_rsa"); err != nil {
+		t.Errorf("CheckKey: %v", err)
+	}
+
+	if err := access.CheckTarget("anything:5432"); err != nil {
+		t.Errorf("CheckTarget: %v", err)
+	}
+
+	if err := access.CheckAgent(host); err != nil {
+		t.Errorf("CheckAgent: %v", err)
+	}
+}
+
+func TestGetHostAccess(t *testing.T) {
+	policy := `{
+		// Comments and trailing commas are allowed
+		"groups": {
+			"group:dev": ["bob@example.com"],
+		},
+		"rules": [
+			{ "src": ["group:dev"], "hosts": ["*.dev.example.com"], "users": ["*"] },
+			{ "src": ["tag:ops"], "hosts": ["*"], "users": ["root"] },
+			{ "src": ["carol@example.com"], "hosts": [], "users": ["*"] },
+		],
+	}`
+
+	policyPath := filepath.Join(t.TempDir(), "policy.hujson")
+
+	if err := os.WriteFile(policyPath, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		login   string
+		tags    []string
+		host    SshHost
+		wantErr bool
+	}{
+		{name: "group member", login: "bob@example.com", host: SshHost{User: "bob", Address: "web.dev.example.com", Port: 22}},
+		{name: "tagged node", login: "dave@example.com", tags: []string{"tag:ops"}, host: SshHost{User: "root", Address: "prod", Port: 22}},
+		{name: "no rule", login: "alice@example.com", wantErr: true},
+		{name: "rule without hosts", login: "carol@example.com", wantErr: true},
+	}
+
+	t.Setenv("TS_TERM_POLICY", policyPath)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			who := &apitype.WhoIsResponse{
+				Node:        &tailcfg.Node{Tags: tt.tags},
+				UserProfile: &tailcfg.UserProfile{LoginName: tt.login},
+			}
+
+			access, err := getHostAccess(who)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("getHostAccess(%q) = %+v, want an error", tt.login, access)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getHostAccess(%q): %v", tt.login, err)
+			}
+
+			if err = access.Check(tt.host); err != nil {
+				t.Errorf("Check(%+v): %v", tt.host, err)
+			}
+		})
+	}
+
+	t.Setenv("TS_TERM_POLICY", "")
+
+	access, err := getHostAccess(&apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{}})
+	if access != nil || err != nil {
+		t.Errorf("getHostAccess without a policy = %+v, %v, want nil", access, err)
+	}
+}
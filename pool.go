@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultPoolTTL is how long a warm node waits to be used when TS_TERM_POOL_TTL isn't set.
+const defaultPoolTTL time.Duration = 30 * time.Minute
+
+// poolStartTimeout is how long a warm node has to reach the running state.
+const poolStartTimeout time.Duration = 2 * time.Minute
+
+// poolStats describes the warm node pool.
+type poolStats struct {
+	Size     int   `json:"size"`
+	TTL      int64 `json:"ttl"` // Seconds a warm node waits to be used
+	Ready    int   `json:"ready"`
+	Starting int   `json:"starting"`
+	// Hits are the connections given a warm node.
+	Hits int64 `json:"hits"`
+	// Misses are the connections which created their own node.
+	Misses  int64 `json:"misses"`
+	Expired int64 `json:"expired"`
+	Failed  int64 `json:"failed"`
+}
+
+// nodePool keeps warm nodes running so connections skip the node's startup.
+// Taken nodes are replaced in the background and unused nodes are replaced once they expire.
+//
+// A nil pool has no nodes.
+type nodePool struct {
+	size     int
+	ttl      time.Duration
+	enroll   *enroller
+	nodes    []*tsNode
+	starting int
+	stats    poolStats
+	// ctx is the pool's lifetime set by Start.
+	ctx context.Context
+	mu  *sync.Mutex
+}
+
+// newNodePool creates the pool of TS_TERM_POOL_SIZE nodes
+// or returns nil if the pool is disabled.
+// Warm nodes can't wait for a user to log them in so the pool requires an enroller.
+func newNodePool(enroll *enroller) (*nodePool, error) {
+	size, err := getPoolSize()
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	if enroll == nil {
+		return nil, errors.New("warm nodes require TS_TERM_AUTHKEY or TS_TERM_OAUTH_CLIENT_SECRET")
+	}
+
+	p := &nodePool{
+		size:   size,
+		ttl:    getPoolTTL(),
+		enroll: enroll,
+		ctx:    context.Background(),
+		mu:     &sync.Mutex{},
+	}
+
+	return p, nil
+}
+
+// Start fills the pool and expires its unused nodes until the context is done.
+func (p *nodePool) Start(ctx context.Context) {
+	if p == nil {
+		return
+	}
+
+	log.Printf("Keeping %v warm nodes for %v", p.size, p.ttl)
+
+	p.mu.Lock()
+	p.ctx = ctx
+	p.mu.Unlock()
+
+	p.fill()
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				p.closeAll()
+				return
+			case <-ticker.C:
+				p.expire()
+				p.fill()
+			}
+		}
+	}()
+}
+
+// Take removes a warm node from the pool and starts its replacement.
+// It returns false if no node is ready.
+func (p *nodePool) Take() (*tsNode, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+
+	if len(p.nodes) == 0 {
+		p.stats.Misses++
+		p.mu.Unlock()
+
+		p.fill()
+		return nil, false
+	}
+
+	node := p.nodes[0]
+	p.nodes = p.nodes[1:]
+	p.stats.Hits++
+	p.mu.Unlock()
+
+	p.fill()
+
+	return node, true
+}
+
+// Stats returns the pool's stats.
+func (p *nodePool) Stats() poolStats {
+	if p == nil {
+		return poolStats{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Size = p.size
+	stats.TTL = int64(p.ttl.Seconds())
+	stats.Ready = len(p.nodes)
+	stats.Starting = p.starting
+
+	return stats
+}
+
+// fill starts nodes in the background until the pool is full.
+func (p *nodePool) fill() {
+	p.mu.Lock()
+	ctx := p.ctx
+
+	if ctx.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+
+	missing := p.size - len(p.nodes) - p.starting
+	p.starting += max(missing, 0)
+	p.mu.Unlock()
+
+	for range missing {
+		go p.startNode(ctx)
+	}
+}
+
+// startNode starts a node and adds it to the pool once it's running.
+func (p *nodePool) startNode(ctx context.Context) {
+	node, err := p.startWarmNode(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.starting--
+
+	if err != nil {
+		p.stats.Failed++
+		log.Printf("pool node: %v", err)
+		return
+	}
+
+	if ctx.Err() != nil {
+		node.Close()
+		return
+	}
+
+	p.nodes = append(p.nodes, node)
+}
+
+func (p *nodePool) startWarmNode(ctx context.Context) (*tsNode, error) {
+	upCtx, cancel := context.WithTimeout(ctx, poolStartTimeout)
+	defer cancel()
+
+	node, err := newEphemeralNode(upCtx, p.enroll)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = node.server.Up(upCtx); err != nil {
+		node.Close()
+		return nil, fmt.Errorf("%v up: %w", node.server.Hostname, err)
+	}
+
+	log.Printf("Warm node %v is running", node.server.Hostname)
+
+	return node, nil
+}
+
+// expire closes the nodes which waited longer than the TTL to be used.
+func (p *nodePool) expire() {
+	p.mu.Lock()
+	var expired []*tsNode
+
+	fresh := p.nodes[:0]
+
+	for _, node := range p.nodes {
+		if time.Since(node.created) > p.ttl {
+			expired = append(expired, node)
+		} else {
+			fresh = append(fresh, node)
+		}
+	}
+
+	p.nodes = fresh
+	p.stats.Expired += int64(len(expired))
+	p.mu.Unlock()
+
+	for _, node := range expired {
+		log.Printf("Warm node %v expired", node.server.Hostname)
+		node.Close()
+	}
+}
+
+func (p *nodePool) closeAll() {
+	p.mu.Lock()
+	nodes := p.nodes
+	p.nodes = nil
+	p.mu.Unlock()
+
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+// getPoolSize returns the number of warm nodes to keep. The pool is disabled by default.
+func getPoolSize() (int, error) {
+	sizeStr := os.Getenv("TS_TERM_POOL_SIZE")
+	if sizeStr == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("pool size %q must be a positive integer", sizeStr)
+	}
+
+	return size, nil
+}
+
+// getPoolTTL returns how long a warm node waits to be used before it's replaced.
+func getPoolTTL() time.Duration {
+	ttlStr := os.Getenv("TS_TERM_POOL_TTL")
+	if ttlStr == "" {
+		return defaultPoolTTL
+	}
+
+	ttl, err := time.ParseDuration(ttlStr)
+	if err != nil || ttl <= 0 {
+		log.Printf("pool ttl %q: must be a positive Go duration. Using %v.", ttlStr, defaultPoolTTL)
+		return defaultPoolTTL
+	}
+
+	return ttl
+}
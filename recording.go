@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// recordPolicy is what's recorded of each session.
+type recordPolicy string
+
+const (
+	recordOff    recordPolicy = "off"
+	recordOutput recordPolicy = "output"
+	// recordInput records the session's input as well as its output.
+	recordInput recordPolicy = "input"
+)
+
+// castHeader is the header line of an asciicast v2 recording.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Metadata  recordingMeta     `json:"ts_term"`
+}
+
+// recordingMeta identifies who recorded the session and where.
+type recordingMeta struct {
+	Session string `json:"session"`
+	// User is the login name of the Tailscale user who opened the session.
+	User string `json:"user"`
+	Node string `json:"node"`
+	// Host is the SSH target. ex. 'user@host:22'
+	Host string `json:"host"`
+}
+
+// recorder writes a session's terminal events to an asciicast v2 file.
+// A nil recorder records nothing.
+type recorder struct {
+	file   *os.File
+	start  time.Time
+	policy recordPolicy
+	closed bool
+	mu     *sync.Mutex
+}
+
+// startRecording starts recording the session if the recording policy isn't off.
+func startRecording(meta recordingMeta, width int, height int) (*recorder, error) {
+	policy := getRecordPolicy()
+	if policy == recordOff {
+		return nil, nil
+	}
+
+	dir, err := getRecordDir()
+	if err != nil {
+		return nil, fmt.Errorf("record dir: %w", err)
+	}
+
+	return newRecorder(policy, dir, meta, width, height)
+}
+
+// newRecorder creates the session's recording in the directory
+// or returns nil if recording is off.
+func newRecorder(policy recordPolicy, dir string, meta recordingMeta, width int, height int) (*recorder, error) {
+	if policy == recordOff {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	start := time.Now()
+
+	// The session ID is chosen by the browser so it's kept out of the file name.
+	// The header's metadata identifies the session.
+	name := fmt.Sprintf("%v-%v.cast", start.UTC().Format("20060102-150405"), uuid.NewString())
+
+	file, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+
+	header := castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%v on %v", meta.Host, meta.Node),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+		Metadata:  meta,
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("header marshal: %w", err)
+	}
+
+	if _, err = file.Write(append(headerBytes, '\n')); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("header write: %w", err)
+	}
+
+	log.Printf("Recording session %v to %v", meta.Session, file.Name())
+
+	r := &recorder{
+		file:   file,
+		start:  start,
+		policy: policy,
+		mu:     &sync.Mutex{},
+	}
+
+	return r, nil
+}
+
+// Output records the terminal output.
+func (r *recorder) Output(data []byte) {
+	r.writeEvent("o", string(data))
+}
+
+// Input records the user's input if the policy captures input.
+func (r *recorder) Input(data string) {
+	if r == nil || r.policy != recordInput {
+		return
+	}
+
+	r.writeEvent("i", data)
+}
+
+// Resize records the terminal's size change.
+func (r *recorder) Resize(cols int, rows int) {
+	r.writeEvent("r", fmt.Sprintf("%vx%v", cols, rows))
+}
+
+// Banner returns the notice shown to the user of a recorded session.
+func (r *recorder) Banner() string {
+	if r.policy == recordInput {
+		return "This session's output and input are being recorded."
+	}
+
+	return "This session's output is being recorded."
+}
+
+func (r *recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	return r.file.Close()
+}
+
+// writeEvent appends an event line timestamped relative to the recording's start.
+func (r *recorder) writeEvent(code string, data string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The PTY may still be flushing output after the session ended
+	if r.closed {
+		return
+	}
+
+	event := []any{time.Since(r.start).Seconds(), code, data}
+
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("record marshal: %v", err)
+		return
+	}
+
+	if _, err = r.file.Write(append(eventBytes, '\n')); err != nil {
+		log.Printf("record write: %v", err)
+	}
+}
+
+// getRecordPolicy returns the recording policy of the sessions.
+// Recording is off by default.
+func getRecordPolicy() recordPolicy {
+	policy := recordPolicy(os.Getenv("TS_TERM_RECORD"))
+
+	switch policy {
+	case "":
+		return recordOff
+	case recordOff, recordOutput, recordInput:
+		return policy
+	}
+
+	log.Printf("record policy %q: must be %q, %q or %q. Recording is off.", policy, recordOff, recordOutput, recordInput)
+
+	return recordOff
+}
+
+// getRecordDir returns the directory the recordings are written to.
+func getRecordDir() (string, error) {
+	if recordDir := os.Getenv("TS_TERM_RECORD_DIR"); recordDir != "" {
+		return recordDir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".ts-term", "recordings"), nil
+}
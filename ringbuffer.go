@@ -0,0 +1,59 @@
+package main
+
+import "unicode/utf8"
+
+// ringBuffer keeps the most recent bytes written to it
+// up to its size.
+type ringBuffer struct {
+	buf  []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{
+		buf: make([]byte, size),
+	}
+}
+
+// Write writes p to the buffer, overwriting the oldest bytes once the buffer is full.
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	size := len(r.buf)
+
+	if n >= size {
+		copy(r.buf, p[n-size:])
+
+		r.pos = 0
+		r.full = true
+
+		return n, nil
+	}
+
+	copied := copy(r.buf[r.pos:], p)
+	copy(r.buf, p[copied:])
+
+	if r.pos+n >= size {
+		r.full = true
+	}
+
+	r.pos = (r.pos + n) % size
+
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered bytes from oldest to newest.
+// A partial UTF-8 sequence left at the start by overwriting is dropped.
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return append([]byte{}, r.buf[:r.pos]...)
+	}
+
+	b := append(append([]byte{}, r.buf[r.pos:]...), r.buf[:r.pos]...)
+
+	for len(b) > 0 && !utf8.RuneStart(b[0]) {
+		b = b[1:]
+	}
+
+	return b
+}
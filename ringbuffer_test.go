@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{name: "empty", size: 8, want: ""},
+		{name: "partial", size: 8, writes: []string{"abc", "de"}, want: "abcde"},
+		{name: "exactly full", size: 8, writes: []string{"abcd", "efgh"}, want: "abcdefgh"},
+		{name: "wraps", size: 8, writes: []string{"abcdef", "ghij"}, want: "cdefghij"},
+		{name: "wraps twice", size: 4, writes: []string{"abc", "def", "ghi"}, want: "fghi"},
+		{name: "write larger than buffer", size: 4, writes: []string{"ab", "cdefghij"}, want: "ghij"},
+		// The first byte of 'é' is overwritten, leaving its continuation byte
+		{name: "drops partial rune", size: 4, writes: []string{"aé", "xyz"}, want: "xyz"},
+		{name: "keeps whole rune", size: 4, writes: []string{"ab", "éx"}, want: "béx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRingBuffer(tt.size)
+
+			for _, w := range tt.writes {
+				n, err := r.Write([]byte(w))
+				if err != nil || n != len(w) {
+					t.Fatalf("Write(%q) = %v, %v, want %v", w, n, err, len(w))
+				}
+			}
+
+			if got := string(r.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferBytesCopies(t *testing.T) {
+	r := newRingBuffer(4)
+	r.Write([]byte("ab"))
+
+	b := r.Bytes()
+	b[0] = 'x'
+
+	if got := string(r.Bytes()); got != "ab" {
+		t.Errorf("Bytes() = %q after modifying a copy, want %q", got, "ab")
+	}
+}
@@ -0,0 +1,1107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sammy-t/ts-term/internal/audit"
+	ws "github.com/sammy-t/ts-term/internal/websocket"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/tsnet"
+)
+
+// resumeBufferSize is the amount of recent output kept for replaying to a resumed session.
+const resumeBufferSize int = 256 * 1024
+
+// inputQueueSize is the number of the owner's messages queued for a session's PTY.
+const inputQueueSize int = 256
+
+// defaultResumeGrace is how long a session is kept alive
+// after its WebSocket closes when TS_TERM_RESUME_GRACE isn't set.
+const defaultResumeGrace time.Duration = 5 * time.Minute
+
+// ownerClient is the key of the owner's terminal size among the session's clients.
+const ownerClient string = ""
+
+// Control decisions of the audit log.
+const (
+	controlGranted  = "granted"
+	controlRevoked  = "revoked"
+	controlLeft     = "left"
+	controlUnshared = "unshared"
+)
+
+// msgWriter writes messages to the browser.
+type msgWriter interface {
+	WriteJSON(msg ws.Message) error
+}
+
+// sessionInfo describes a running session in the session list.
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	Host     string    `json:"host"`
+	User     string    `json:"user"`
+	Node     string    `json:"node"`
+	Started  time.Time `json:"started"`
+	Idle     int64     `json:"idle"` // Seconds since the last input or output
+	Attached bool      `json:"attached"`
+}
+
+// termSession is an SSH shell multiplexed with the node's other sessions
+// on the terminal WebSocket.
+//
+// A connected session outlives its WebSocket for a grace period
+// so the browser can reattach with the session's resume token.
+// Detached sessions keep running until they're reattached or closed.
+type termSession struct {
+	ID string
+	// Owner is the login name of the Tailscale user who opened the session.
+	Owner string
+	// Node is the hostname of the node the session's SSH connection runs on.
+	Node         string
+	conn         ws.SessionConn
+	connNode     string
+	attached     bool
+	token        string
+	output       *ringBuffer
+	detachTimer  *time.Timer
+	user         string
+	host         string
+	started      time.Time
+	lastActivity time.Time
+	client       *ssh.Client
+	session      *ssh.Session
+	stdin        io.Writer
+	fwd          *forwarder
+	rec          *recorder
+	shareToken   string
+	viewers      []*shareViewer
+	sizes        map[string]winSize
+	bytesIn      int64
+	bytesOut     int64
+	// input queues the owner's messages for the PTY.
+	input chan ws.Message
+	// done is closed once the session is closed.
+	done   chan struct{}
+	closed bool
+	mu     *sync.Mutex
+}
+
+func newTermSession(id string, owner string, node string, conn ws.SessionConn) *termSession {
+	now := time.Now()
+
+	t := &termSession{
+		ID:           id,
+		Owner:        owner,
+		Node:         node,
+		conn:         conn,
+		connNode:     node,
+		attached:     true,
+		output:       newRingBuffer(resumeBufferSize),
+		started:      now,
+		lastActivity: now,
+		sizes:        make(map[string]winSize),
+		input:        make(chan ws.Message, inputQueueSize),
+		done:         make(chan struct{}),
+		mu:           &sync.Mutex{},
+	}
+
+	go t.processInput()
+
+	return t
+}
+
+// Run connects to the host and runs a shell until the shell exits
+// or the session is closed.
+// The connection is reattempted with updated configs if the config is invalid, the connection fails
+// or the access policy denies a host.
+func (t *termSession) Run(ctx context.Context, server *tsnet.Server, hostKeyCb ssh.HostKeyCallback, access *hostAccess, cfgData string) error {
+	var sshClient *ssh.Client
+
+	sshCfg, err := parseSshConfig(cfgData)
+	if err == nil {
+		sshClient, err = dialSsh(ctx, server, t.conn, hostKeyCb, access, sshCfg)
+	}
+
+	if err != nil {
+		log.Printf("ssh conn %v: %v", t.ID, err)
+		sshClient, err = reattemptSSH(ctx, server, t.conn, hostKeyCb, access, &sshCfg, err)
+	}
+	// Return if reattempts fail
+	if err != nil {
+		return fmt.Errorf("ssh failed: %w", err)
+	}
+	defer sshClient.Close()
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSshSuccess,
+		Data: fmt.Sprintf("%v@%v", sshCfg.User, sshCfg.Address),
+	}
+
+	if err = t.WriteJSON(wsMsg); err != nil {
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	token := rand.Text()
+
+	t.mu.Lock()
+	t.token = token
+	t.user = sshCfg.User
+	t.host = sshCfg.Address
+	t.mu.Unlock()
+
+	wsMsg = ws.Message{
+		Type: ws.MessageSessionToken,
+		Data: token,
+	}
+
+	if err = t.WriteJSON(wsMsg); err != nil {
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("sess: %w", err)
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,     // enable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+
+	if sshCfg.Options.ForwardAgent {
+		err = access.CheckAgent(sshCfg.SshHost)
+		if err != nil {
+			auditLog.Log(audit.Event{
+				Type:    audit.EventAccessDenied,
+				Node:    t.Node,
+				Session: t.ID,
+				User:    t.Owner,
+				Host:    sshCfg.HostPort(),
+				SshUser: sshCfg.User,
+				Error:   err.Error(),
+			})
+		} else {
+			err = forwardAgent(sshClient, session, sshCfg.Auth)
+		}
+
+		if err != nil {
+			log.Printf("agent %v: %v", t.ID, err)
+			t.writeInfo(fmt.Sprintf("The agent isn't forwarded. %v", err))
+		}
+	}
+
+	// Request a PTY on the SSH session with an arbitrary height and width.
+	// The frontend will send updated height and width once it's connected.
+	if err = session.RequestPty("xterm-256color", 40, 80, modes); err != nil {
+		return fmt.Errorf("req pty: %w", err)
+	}
+
+	meta := recordingMeta{
+		Session: t.ID,
+		User:    t.Owner,
+		Node:    t.Node,
+		Host:    fmt.Sprintf("%v@%v", sshCfg.User, sshCfg.HostPort()),
+	}
+
+	// Don't run the shell unrecorded if the policy requires recording
+	rec, err := startRecording(meta, 80, 40)
+	if err != nil {
+		return fmt.Errorf("recording: %w", err)
+	}
+	defer rec.Close()
+
+	if rec != nil {
+		wsMsg = ws.Message{
+			Type: ws.MessageInfo,
+			Data: rec.Banner(),
+		}
+
+		if err = t.WriteJSON(wsMsg); err != nil {
+			return fmt.Errorf("ws write: %w", err)
+		}
+	}
+
+	fwd := newForwarder(server, sshClient, t, access, t.ID)
+	defer fwd.Close()
+
+	onClosed := func() {
+		session.Close()
+	}
+
+	errPipe, err := session.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("sess err: %w", err)
+	}
+
+	outPipe, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("sess out: %w", err)
+	}
+
+	inPipe, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("sess in: %w", err)
+	}
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+
+	t.client = sshClient
+	t.session = session
+	t.stdin = inPipe
+	t.fwd = fwd
+	t.rec = rec
+	t.mu.Unlock()
+
+	go ptyErrToWs(errPipe, t, rec, onClosed)
+	go ptyToWs(outPipe, t, rec, onClosed)
+
+	if err = session.Shell(); err != nil {
+		return fmt.Errorf("shell: %w", err)
+	}
+
+	auditEvent := audit.Event{
+		Type:    audit.EventSessionStart,
+		Node:    t.Node,
+		Session: t.ID,
+		User:    t.Owner,
+		Host:    sshCfg.HostPort(),
+		SshUser: sshCfg.User,
+	}
+
+	auditLog.Log(auditEvent)
+
+	// Wait for the remote command to exit.
+	// This ensures the i/o pipes stay alive while we're using them.
+	err = session.Wait()
+
+	var exitErr *ssh.ExitError
+
+	if err != nil && !errors.As(err, &exitErr) && !t.isClosed() {
+		err = fmt.Errorf("sess wait: %w", err)
+	} else {
+		err = nil
+	}
+
+	t.auditEnd(auditEvent, exitErr, err)
+
+	return err
+}
+
+// auditEnd writes the end of the session to the audit log
+// with the shell's exit status if it exited.
+func (t *termSession) auditEnd(event audit.Event, exitErr *ssh.ExitError, err error) {
+	t.mu.Lock()
+	event.BytesIn, event.BytesOut = t.bytesIn, t.bytesOut
+	closed := t.closed
+	t.mu.Unlock()
+
+	event.Time = time.Time{}
+	event.Type = audit.EventSessionEnd
+	event.Error = audit.ErrString(err)
+
+	if exitErr != nil {
+		status := exitErr.ExitStatus()
+		event.ExitStatus = &status
+	} else if err == nil && !closed {
+		status := 0
+		event.ExitStatus = &status
+	}
+
+	auditLog.Log(event)
+}
+
+// HandleMsg queues the session's WebSocket message for the PTY
+// so a session waiting on its host doesn't hold up the WebSocket's other sessions.
+// Messages are dropped if the queue is full.
+func (t *termSession) HandleMsg(msg ws.Message) {
+	select {
+	case t.input <- msg:
+	case <-t.done:
+	default:
+		log.Printf("session %v input queue full, dropping %q", t.ID, msg.Type)
+	}
+}
+
+// processInput passes the queued messages to the PTY until the session is closed.
+func (t *termSession) processInput() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case msg := <-t.input:
+			t.handleMsg(msg)
+		}
+	}
+}
+
+// handleMsg passes the message to the PTY.
+// Messages received before the shell is running are dropped.
+func (t *termSession) handleMsg(msg ws.Message) {
+	t.mu.Lock()
+	session, stdin, fwd, rec := t.session, t.stdin, t.fwd, t.rec
+
+	if msg.Type == ws.MessageInput {
+		t.lastActivity = time.Now()
+		t.bytesIn += int64(len(msg.Data))
+	}
+	t.mu.Unlock()
+
+	if session == nil {
+		log.Printf("session %v not running, dropping %q", t.ID, msg.Type)
+		return
+	}
+
+	if msg.Type == ws.MessageSize {
+		t.setSize(ownerClient, msg.Data)
+		return
+	}
+
+	wsToPty(msg, stdin, session, fwd, rec)
+}
+
+// HandleViewerMsg passes the viewer's input to the PTY if the viewer has control.
+// Viewers' terminal sizes take part in sizing the PTY
+// and their other messages are rejected.
+func (t *termSession) HandleViewerMsg(viewer *shareViewer, msg ws.Message) {
+	t.mu.Lock()
+	session, stdin, fwd, rec := t.session, t.stdin, t.fwd, t.rec
+	control := viewer.control
+
+	if msg.Type == ws.MessageInput && control {
+		t.lastActivity = time.Now()
+		t.bytesIn += int64(len(msg.Data))
+	}
+	t.mu.Unlock()
+
+	if session == nil {
+		return
+	}
+
+	switch msg.Type {
+	case ws.MessageInput:
+		if control {
+			wsToPty(msg, stdin, session, fwd, rec)
+			return
+		}
+
+		wsMsg := ws.Message{
+			Type:    ws.MessageInfo,
+			Data:    "The session is read-only.",
+			Session: t.ID,
+		}
+
+		viewer.WriteJSON(wsMsg)
+	case ws.MessageSize:
+		t.setSize(viewer.ID, msg.Data)
+	default:
+		log.Printf("viewer %q rejected %q", viewer.Name, msg.Type)
+	}
+}
+
+// setSize sets the client's terminal size and resizes the PTY.
+func (t *termSession) setSize(client string, data string) {
+	var size winSize
+
+	if err := json.Unmarshal([]byte(data), &size); err != nil {
+		log.Printf("size: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	t.sizes[client] = size
+	t.mu.Unlock()
+
+	t.resizePty()
+}
+
+// resizePty resizes the PTY to the smallest size among the session's clients
+// so the output fits every client's terminal.
+func (t *termSession) resizePty() {
+	t.mu.Lock()
+	session, stdin, fwd, rec := t.session, t.stdin, t.fwd, t.rec
+
+	var smallest winSize
+
+	for _, size := range t.sizes {
+		if smallest.Rows == 0 || size.Rows < smallest.Rows {
+			smallest.Rows, smallest.Y = size.Rows, size.Y
+		}
+
+		if smallest.Cols == 0 || size.Cols < smallest.Cols {
+			smallest.Cols, smallest.X = size.Cols, size.X
+		}
+	}
+	t.mu.Unlock()
+
+	if session == nil || smallest.Rows == 0 || smallest.Cols == 0 {
+		return
+	}
+
+	sizeBytes, err := json.Marshal(smallest)
+	if err != nil {
+		log.Printf("size marshal: %v", err)
+		return
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSize,
+		Data: string(sizeBytes),
+	}
+
+	wsToPty(wsMsg, stdin, session, fwd, rec)
+}
+
+// WriteJSON writes the message to the attached WebSocket.
+// Output is also kept for replaying to a resumed session
+// and messages written while detached are dropped.
+func (t *termSession) WriteJSON(msg ws.Message) error {
+	t.mu.Lock()
+	if msg.Type == ws.MessageOutput {
+		t.output.Write([]byte(msg.Data))
+		t.lastActivity = time.Now()
+		t.bytesOut += int64(len(msg.Data))
+	}
+
+	conn, attached := t.conn, t.attached
+	viewers := slices.Clone(t.viewers)
+	t.mu.Unlock()
+
+	msg.Session = t.ID
+
+	// Fan the output out to the read-only viewers
+	if msg.Type == ws.MessageOutput {
+		for _, viewer := range viewers {
+			viewer.WriteJSON(msg)
+		}
+	}
+
+	if !attached {
+		return nil
+	}
+
+	// Don't end the session if the WebSocket dropped.
+	// The hub detaches the session once it notices.
+	if err := conn.WriteJSON(msg); err != nil {
+		log.Printf("session %v ws write: %v", t.ID, err)
+	}
+
+	return nil
+}
+
+// IsAttached reports whether the session is attached to the WebSocket.
+func (t *termSession) IsAttached(conn *ws.SyncedWebsocket) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.attached && t.conn.Hub.Conn == conn
+}
+
+// Detach detaches the session from the WebSocket
+// and keeps the session running until it's reattached or closed.
+func (t *termSession) Detach(conn *ws.SyncedWebsocket) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.attached || t.conn.Hub.Conn != conn {
+		return errors.New("session not attached")
+	}
+
+	if t.token == "" {
+		return errors.New("session not connected")
+	}
+
+	t.attached = false
+	t.connNode = ""
+
+	log.Printf("Detached session %v", t.ID)
+
+	return nil
+}
+
+// Disconnect detaches the session from its closed WebSocket and closes the session
+// unless it's resumed within the grace period.
+// Sessions which aren't connected yet can't be resumed and are closed immediately.
+func (t *termSession) Disconnect(conn *ws.SyncedWebsocket, grace time.Duration) {
+	t.mu.Lock()
+
+	if !t.attached || t.conn.Hub.Conn != conn {
+		t.mu.Unlock()
+		return
+	}
+
+	t.attached = false
+
+	if grace <= 0 || t.token == "" {
+		t.mu.Unlock()
+		t.Close()
+		return
+	}
+
+	log.Printf("Disconnected session %v. Closing in %v unless resumed.", t.ID, grace)
+
+	t.detachTimer = time.AfterFunc(grace, func() {
+		log.Printf("session %v resume grace expired", t.ID)
+		t.Close()
+	})
+
+	t.mu.Unlock()
+}
+
+// Resume reattaches the session to the reconnected WebSocket
+// of the browser holding the session's resume token.
+// The token and Tailscale user must match the session's.
+func (t *termSession) Resume(conn ws.SessionConn, node string, owner string, token string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) != 1 {
+		return errors.New("invalid resume token")
+	}
+
+	return t.attach(conn, node, owner)
+}
+
+// Attach attaches the session to the WebSocket served by the node
+// and sends the resume token.
+// A session attached to another WebSocket is taken over.
+// The Tailscale user must match the session's.
+func (t *termSession) Attach(conn ws.SessionConn, node string, owner string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token == "" {
+		return errors.New("session not connected")
+	}
+
+	prevConn, prevAttached := t.conn, t.attached
+
+	if err := t.attach(conn, node, owner); err != nil {
+		return err
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSessionToken,
+		Data: t.token,
+	}
+
+	if err := conn.WriteJSON(wsMsg); err != nil {
+		log.Printf("session %v ws write: %v", t.ID, err)
+	}
+
+	if prevAttached && prevConn.Hub.Conn != conn.Hub.Conn {
+		writeSessionClosed(prevConn, errors.New("attached from another browser"))
+	}
+
+	return nil
+}
+
+// attach replays the recent output to the WebSocket and attaches the session to it.
+// The session must be locked.
+func (t *termSession) attach(conn ws.SessionConn, node string, owner string) error {
+	if t.closed {
+		return errors.New("session closed")
+	}
+
+	if owner != t.Owner {
+		return fmt.Errorf("%q is not the session owner", owner)
+	}
+
+	if t.detachTimer != nil {
+		t.detachTimer.Stop()
+		t.detachTimer = nil
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSessionResume,
+		Data: string(t.output.Bytes()),
+	}
+
+	if err := conn.WriteJSON(wsMsg); err != nil {
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	t.conn = conn
+	t.connNode = node
+	t.attached = true
+
+	return nil
+}
+
+// Info returns the session's details for the session list.
+func (t *termSession) Info() sessionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return sessionInfo{
+		ID:       t.ID,
+		Host:     t.host,
+		User:     t.user,
+		Node:     t.Node,
+		Started:  t.started,
+		Idle:     int64(time.Since(t.lastActivity).Seconds()),
+		Attached: t.attached,
+	}
+}
+
+// usesNode reports whether the session runs on the node
+// or is attached to, or awaiting resume on, a WebSocket served by the node.
+func (t *termSession) usesNode(node string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.Node == node || t.connNode == node
+}
+
+// Share returns the token of the session's share link
+// which lets other tailnet users view the session.
+func (t *termSession) Share() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || t.token == "" {
+		return "", errors.New("session not connected")
+	}
+
+	if t.shareToken == "" {
+		t.shareToken = rand.Text()
+	}
+
+	return t.shareToken, nil
+}
+
+// Unshare revokes the session's share link and disconnects its viewers.
+func (t *termSession) Unshare() {
+	t.mu.Lock()
+	viewers := t.viewers
+	var controlling []*shareViewer
+
+	t.shareToken = ""
+	t.viewers = nil
+
+	for _, viewer := range viewers {
+		delete(t.sizes, viewer.ID)
+
+		if viewer.control {
+			controlling = append(controlling, viewer)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, viewer := range controlling {
+		t.auditControl(viewer, controlUnshared)
+	}
+
+	for _, viewer := range viewers {
+		viewer.Close("sharing stopped")
+	}
+
+	t.resizePty()
+	t.writeViewers()
+}
+
+// AddViewer adds a viewer holding the share token
+// and replays the recent output to it.
+// Viewers are read-only until the owner grants them control.
+// The owner is notified the viewer joined.
+func (t *termSession) AddViewer(viewer *shareViewer, token string) error {
+	t.mu.Lock()
+
+	if t.closed {
+		t.mu.Unlock()
+		return errors.New("session closed")
+	}
+
+	if t.shareToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(t.shareToken)) != 1 {
+		t.mu.Unlock()
+		return errors.New("invalid share token")
+	}
+
+	wsMsg := ws.Message{
+		Type:    ws.MessageSessionResume,
+		Data:    string(t.output.Bytes()),
+		Session: t.ID,
+	}
+
+	if err := viewer.WriteJSON(wsMsg); err != nil {
+		t.mu.Unlock()
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	t.viewers = append(t.viewers, viewer)
+	t.mu.Unlock()
+
+	log.Printf("%q is viewing session %v", viewer.Name, t.ID)
+
+	auditLog.Log(audit.Event{
+		Type:     audit.EventShareView,
+		Node:     t.Node,
+		Session:  t.ID,
+		User:     viewer.Name,
+		UserNode: viewer.Node,
+	})
+
+	t.writeInfo(fmt.Sprintf("%v is viewing the session from %v.", viewer.Name, viewer.Node))
+	t.writeViewers()
+
+	return nil
+}
+
+// RemoveViewer removes the viewer and notifies the owner the viewer left.
+func (t *termSession) RemoveViewer(viewer *shareViewer) {
+	t.mu.Lock()
+	found := slices.Contains(t.viewers, viewer)
+	control := viewer.control
+
+	t.viewers = slices.DeleteFunc(t.viewers, func(v *shareViewer) bool {
+		return v == viewer
+	})
+
+	delete(t.sizes, viewer.ID)
+	t.mu.Unlock()
+
+	if !found {
+		return
+	}
+
+	log.Printf("%q stopped viewing session %v", viewer.Name, t.ID)
+
+	if control {
+		t.auditControl(viewer, controlLeft)
+	}
+
+	t.resizePty()
+
+	t.writeInfo(fmt.Sprintf("%v stopped viewing the session.", viewer.Name))
+	t.writeViewers()
+}
+
+// SetControl grants or revokes the viewer's keyboard control of the session.
+// Viewers with control type into the session alongside the owner.
+func (t *termSession) SetControl(viewerID string, control bool) error {
+	t.mu.Lock()
+	idx := slices.IndexFunc(t.viewers, func(v *shareViewer) bool {
+		return v.ID == viewerID
+	})
+
+	if idx < 0 {
+		t.mu.Unlock()
+		return fmt.Errorf("viewer %q not found", viewerID)
+	}
+
+	viewer := t.viewers[idx]
+	viewer.control = control
+	t.mu.Unlock()
+
+	msg := "%v no longer has control of the session."
+	if control {
+		msg = "%v has control of the session."
+	}
+
+	if control {
+		t.auditControl(viewer, controlGranted)
+	} else {
+		t.auditControl(viewer, controlRevoked)
+	}
+
+	ctrlBytes, err := json.Marshal(controlMsg{Control: control})
+	if err != nil {
+		return fmt.Errorf("control marshal: %w", err)
+	}
+
+	wsMsg := ws.Message{
+		Type:    ws.MessageSessionControl,
+		Data:    string(ctrlBytes),
+		Session: t.ID,
+	}
+
+	viewer.WriteJSON(wsMsg)
+
+	wsMsg = ws.Message{
+		Type:    ws.MessageInfo,
+		Data:    fmt.Sprintf(msg, "You"),
+		Session: t.ID,
+	}
+
+	viewer.WriteJSON(wsMsg)
+
+	t.writeInfo(fmt.Sprintf(msg, viewer.Name))
+	t.writeViewers()
+
+	return nil
+}
+
+// auditControl writes the change of the viewer's control to the audit log.
+func (t *termSession) auditControl(viewer *shareViewer, decision string) {
+	auditLog.Log(audit.Event{
+		Type:     audit.EventControl,
+		Node:     t.Node,
+		Session:  t.ID,
+		User:     t.Owner,
+		Target:   viewer.Name,
+		Decision: decision,
+	})
+}
+
+// writeViewers writes the session's viewers to the owner.
+func (t *termSession) writeViewers() {
+	t.mu.Lock()
+	infos := []viewerInfo{}
+
+	for _, viewer := range t.viewers {
+		info := viewerInfo{
+			ID:      viewer.ID,
+			Name:    viewer.Name,
+			Node:    viewer.Node,
+			Control: viewer.control,
+		}
+
+		infos = append(infos, info)
+	}
+	t.mu.Unlock()
+
+	infoBytes, err := json.Marshal(infos)
+	if err != nil {
+		log.Printf("viewers marshal: %v", err)
+		return
+	}
+
+	wsMsg := ws.Message{
+		Type: ws.MessageSessionViewers,
+		Data: string(infoBytes),
+	}
+
+	t.WriteJSON(wsMsg)
+}
+
+// writeInfo writes the info message to the session's owner.
+func (t *termSession) writeInfo(info string) {
+	wsMsg := ws.Message{
+		Type: ws.MessageInfo,
+		Data: info,
+	}
+
+	t.WriteJSON(wsMsg)
+}
+
+// Client returns the session's SSH client
+// or nil if the session isn't connected.
+func (t *termSession) Client() *ssh.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.client
+}
+
+// Close ends the session's shell.
+func (t *termSession) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.closed {
+		close(t.done)
+	}
+
+	t.closed = true
+
+	if t.detachTimer != nil {
+		t.detachTimer.Stop()
+	}
+
+	for _, viewer := range t.viewers {
+		viewer.Close("session ended")
+	}
+
+	t.shareToken = ""
+	t.viewers = nil
+
+	if t.session != nil {
+		t.session.Close()
+	}
+
+	if t.client != nil {
+		t.client.Close()
+	}
+}
+
+func (t *termSession) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closed
+}
+
+// sessionStore tracks the sessions of every node by ID
+// so the nodes' handlers can reuse their authenticated connections
+// and sessions can be reattached from other nodes.
+type sessionStore struct {
+	sessions map[string]*termSession
+	nodes    map[string]func()
+	mu       *sync.Mutex
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*termSession),
+		nodes:    make(map[string]func()),
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (s *sessionStore) Add(sess *termSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// IDs are chosen by the browser so only canonical UUIDs are accepted
+	if id, err := uuid.Parse(sess.ID); err != nil || id.String() != sess.ID {
+		return fmt.Errorf("invalid session id %q", sess.ID)
+	}
+
+	if _, ok := s.sessions[sess.ID]; ok {
+		return fmt.Errorf("session %q already exists", sess.ID)
+	}
+
+	s.sessions[sess.ID] = sess
+
+	return nil
+}
+
+func (s *sessionStore) Get(id string) (*termSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+
+	return sess, ok
+}
+
+func (s *sessionStore) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+// List returns the connected sessions of the Tailscale user from oldest to newest.
+func (s *sessionStore) List(owner string) []sessionInfo {
+	infos := []sessionInfo{}
+
+	for _, sess := range s.all() {
+		if sess.Owner != owner {
+			continue
+		}
+
+		info := sess.Info()
+		if info.Host == "" {
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b sessionInfo) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	return infos
+}
+
+// AddNode registers the node's close function
+// which is called once the node has no sessions left.
+func (s *sessionStore) AddNode(node string, closeNode func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[node] = closeNode
+}
+
+// CloseIdleNodes closes the nodes which neither run a session
+// nor serve the WebSocket of a session.
+func (s *sessionStore) CloseIdleNodes() {
+	sessions := s.all()
+
+	s.mu.Lock()
+	idle := []func(){}
+
+	for node, closeNode := range s.nodes {
+		inUse := slices.ContainsFunc(sessions, func(sess *termSession) bool {
+			return sess.usesNode(node)
+		})
+
+		if inUse {
+			continue
+		}
+
+		delete(s.nodes, node)
+		idle = append(idle, closeNode)
+	}
+	s.mu.Unlock()
+
+	for _, closeNode := range idle {
+		closeNode()
+	}
+}
+
+// GetConn returns the session if it's attached to the WebSocket.
+func (s *sessionStore) GetConn(id string, conn *ws.SyncedWebsocket) (*termSession, bool) {
+	sess, ok := s.Get(id)
+	if !ok || !sess.IsAttached(conn) {
+		return nil, false
+	}
+
+	return sess, true
+}
+
+// DisconnectConn disconnects the sessions attached to the closed WebSocket.
+func (s *sessionStore) DisconnectConn(conn *ws.SyncedWebsocket, grace time.Duration) {
+	for _, sess := range s.all() {
+		sess.Disconnect(conn, grace)
+	}
+}
+
+func (s *sessionStore) all() []*termSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []*termSession{}
+
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+
+	return sessions
+}
+
+// getResumeGrace returns how long sessions are kept alive after their WebSocket closes.
+// A zero duration closes sessions with their WebSocket.
+func getResumeGrace() time.Duration {
+	graceEnv := os.Getenv("TS_TERM_RESUME_GRACE")
+	if graceEnv == "" {
+		return defaultResumeGrace
+	}
+
+	grace, err := time.ParseDuration(graceEnv)
+	if err != nil {
+		log.Printf("resume grace %q: %v. Using %v.", graceEnv, err, defaultResumeGrace)
+		return defaultResumeGrace
+	}
+
+	return grace
+}
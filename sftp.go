@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/sftp"
+	ws "github.com/sammy-t/ts-term/internal/websocket"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/client/local"
+)
+
+// sftpChunkSize is the size of the file chunks sent over the WebSocket.
+const sftpChunkSize int = 32 * 1024
+
+// sftpProgressInterval is the number of bytes transferred between progress messages.
+const sftpProgressInterval int64 = 256 * 1024
+
+// sftpMsg is the data of the SFTP WebSocket messages.
+// Only the fields relevant to the message type are set.
+type sftpMsg struct {
+	ID      string      `json:"id,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Bytes   int64       `json:"bytes,omitempty"`
+	Data    []byte      `json:"data,omitempty"`
+	Entries []sftpEntry `json:"entries,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+type sftpEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+type sftpTransfer struct {
+	file     *sftp.File
+	path     string
+	upload   bool
+	size     int64
+	bytes    int64
+	canceled chan struct{}
+}
+
+// sftpConn serves SFTP requests from the WebSocket
+// using the SFTP subsystem of an existing SSH client.
+type sftpConn struct {
+	conn      *ws.SyncedWebsocket
+	client    *sftp.Client
+	transfers map[string]*sftpTransfer
+	mu        *sync.Mutex
+}
+
+// getSftpHandler returns a handler serving SFTP over a WebSocket
+// using the SSH client of the node's session in the `session` query param.
+// Only the Tailscale user who owns the SSH session is allowed.
+func getSftpHandler(client *local.Client, upgrader websocket.Upgrader, sessions *sessionStore) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received sftp request %q", r.URL.Path)
+
+		var sshClient *ssh.Client
+
+		sess, ok := sessions.Get(r.URL.Query().Get("session"))
+		if ok {
+			sshClient = sess.Client()
+		}
+
+		if sshClient == nil {
+			http.Error(w, "no active ssh session", http.StatusConflict)
+			return
+		}
+
+		who, err := client.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Printf("sftp ts who: %v", err)
+			http.Error(w, "unknown tailscale user", http.StatusForbidden)
+			return
+		}
+
+		if who.UserProfile.LoginName != sess.Owner {
+			log.Printf("sftp denied %q", who.UserProfile.LoginName)
+			http.Error(w, "not the session owner", http.StatusForbidden)
+			return
+		}
+
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("sftp websocket: %v", err)
+			return
+		}
+
+		conn := &ws.SyncedWebsocket{
+			Conn: wsConn,
+			Mu:   &sync.Mutex{},
+		}
+		defer conn.Close()
+
+		sConn, err := newSftpConn(conn, sshClient)
+		if err != nil {
+			log.Printf("sftp: %v", err)
+
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "sftp unavailable")
+			conn.WriteMessage(websocket.CloseMessage, closeMsg)
+			return
+		}
+
+		sConn.Serve()
+	}
+
+	return h
+}
+
+func newSftpConn(conn *ws.SyncedWebsocket, sshClient *ssh.Client) (*sftpConn, error) {
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, fmt.Errorf("sftp client: %w", err)
+	}
+
+	s := &sftpConn{
+		conn:      conn,
+		client:    client,
+		transfers: make(map[string]*sftpTransfer),
+		mu:        &sync.Mutex{},
+	}
+
+	return s, nil
+}
+
+// Serve reads the WebSocket messages and handles the SFTP requests
+// until the WebSocket is closed.
+func (s *sftpConn) Serve() {
+	defer s.Close()
+
+	for {
+		var msg ws.Message
+
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			log.Printf("sftp ws read: %v", err)
+			return
+		}
+
+		var req sftpMsg
+
+		if err := json.Unmarshal([]byte(msg.Data), &req); err != nil {
+			log.Printf("sftp msg: %v", err)
+			continue
+		}
+
+		var err error
+
+		switch msg.Type {
+		case ws.MessageSftpList:
+			err = s.list(req)
+		case ws.MessageSftpDownload:
+			go func() {
+				if err := s.download(req); err != nil {
+					s.writeErr(req.ID, err)
+				}
+			}()
+		case ws.MessageSftpUpload:
+			err = s.startUpload(req)
+		case ws.MessageSftpChunk:
+			err = s.writeChunk(req)
+		case ws.MessageSftpDone:
+			err = s.finishUpload(req)
+		case ws.MessageSftpCancel:
+			err = s.cancel(req.ID)
+		default:
+			log.Printf("sftp ws type: %v, data: %q", msg.Type, msg.Data)
+		}
+
+		if err != nil {
+			s.writeErr(req.ID, err)
+		}
+	}
+}
+
+// Close cancels any active transfers and closes the SFTP client.
+func (s *sftpConn) Close() error {
+	s.mu.Lock()
+	ids := []string{}
+
+	for id := range s.transfers {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.cancel(id)
+	}
+
+	return s.client.Close()
+}
+
+// list writes the entries of the requested directory.
+// An empty path lists the working directory.
+func (s *sftpConn) list(req sftpMsg) error {
+	dir := req.Path
+
+	if dir == "" {
+		wd, err := s.client.Getwd()
+		if err != nil {
+			return fmt.Errorf("getwd: %w", err)
+		}
+
+		dir = wd
+	}
+
+	dir, err := s.client.RealPath(dir)
+	if err != nil {
+		return fmt.Errorf("realpath: %w", err)
+	}
+
+	infos, err := s.client.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("readdir: %w", err)
+	}
+
+	resp := sftpMsg{
+		ID:      req.ID,
+		Path:    dir,
+		Entries: []sftpEntry{},
+	}
+
+	for _, info := range infos {
+		resp.Entries = append(resp.Entries, sftpEntry{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		})
+	}
+
+	return s.write(ws.MessageSftpList, resp)
+}
+
+// download streams the requested file to the WebSocket in chunks.
+func (s *sftpConn) download(req sftpMsg) error {
+	file, err := s.client.Open(req.Path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	transfer, err := s.addTransfer(req.ID, file, req.Path, false, info.Size())
+	if err != nil {
+		return err
+	}
+	defer s.removeTransfer(req.ID)
+
+	b := make([]byte, sftpChunkSize)
+
+	var reported int64
+
+	for {
+		select {
+		case <-transfer.canceled:
+			return errors.New("transfer canceled")
+		default:
+		}
+
+		n, err := file.Read(b)
+
+		if n > 0 {
+			transfer.bytes += int64(n)
+
+			chunk := sftpMsg{
+				ID:   req.ID,
+				Data: b[:n],
+			}
+
+			if wErr := s.write(ws.MessageSftpChunk, chunk); wErr != nil {
+				return wErr
+			}
+
+			if transfer.bytes-reported >= sftpProgressInterval {
+				reported = transfer.bytes
+				s.writeProgress(transfer, req.ID)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+	}
+
+	s.writeProgress(transfer, req.ID)
+
+	log.Printf("sftp downloaded %q [%v]", req.Path, transfer.bytes)
+
+	return s.write(ws.MessageSftpDone, sftpMsg{ID: req.ID, Path: req.Path, Bytes: transfer.bytes})
+}
+
+// startUpload creates the requested file to write the following chunks to.
+func (s *sftpConn) startUpload(req sftpMsg) error {
+	file, err := s.client.OpenFile(req.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	if _, err = s.addTransfer(req.ID, file, req.Path, true, req.Size); err != nil {
+		file.Close()
+		return err
+	}
+
+	return s.write(ws.MessageSftpProgress, sftpMsg{ID: req.ID, Size: req.Size})
+}
+
+// writeChunk writes the uploaded chunk to the transfer's file.
+func (s *sftpConn) writeChunk(req sftpMsg) error {
+	transfer, ok := s.getTransfer(req.ID)
+	if !ok {
+		return fmt.Errorf("transfer %q not found", req.ID)
+	}
+
+	n, err := transfer.file.Write(req.Data)
+	transfer.bytes += int64(n)
+
+	if err != nil {
+		s.cancel(req.ID)
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Progress is reported for every chunk
+	// so the browser can pace the upload.
+	s.writeProgress(transfer, req.ID)
+
+	return nil
+}
+
+// finishUpload closes the uploaded file.
+func (s *sftpConn) finishUpload(req sftpMsg) error {
+	transfer, ok := s.getTransfer(req.ID)
+	if !ok {
+		return fmt.Errorf("transfer %q not found", req.ID)
+	}
+
+	s.removeTransfer(req.ID)
+
+	if err := transfer.file.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	log.Printf("sftp uploaded %q [%v]", transfer.path, transfer.bytes)
+
+	return s.write(ws.MessageSftpDone, sftpMsg{ID: req.ID, Path: transfer.path, Bytes: transfer.bytes})
+}
+
+// cancel stops the transfer.
+// Partially uploaded files are removed.
+func (s *sftpConn) cancel(id string) error {
+	transfer, ok := s.getTransfer(id)
+	if !ok {
+		return fmt.Errorf("transfer %q not found", id)
+	}
+
+	s.removeTransfer(id)
+	close(transfer.canceled)
+
+	transfer.file.Close()
+
+	log.Printf("sftp canceled %q", transfer.path)
+
+	// Downloads report the cancellation once their loop exits.
+	if !transfer.upload {
+		return nil
+	}
+
+	if err := s.client.Remove(transfer.path); err != nil {
+		log.Printf("sftp remove partial: %v", err)
+	}
+
+	return errors.New("transfer canceled")
+}
+
+func (s *sftpConn) addTransfer(id string, file *sftp.File, filePath string, upload bool, size int64) (*sftpTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.transfers[id]; ok || id == "" {
+		return nil, fmt.Errorf("invalid transfer id %q", id)
+	}
+
+	transfer := &sftpTransfer{
+		file:     file,
+		path:     path.Clean(filePath),
+		upload:   upload,
+		size:     size,
+		canceled: make(chan struct{}),
+	}
+
+	s.transfers[id] = transfer
+
+	return transfer, nil
+}
+
+func (s *sftpConn) getTransfer(id string) (*sftpTransfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfer, ok := s.transfers[id]
+
+	return transfer, ok
+}
+
+func (s *sftpConn) removeTransfer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.transfers, id)
+}
+
+func (s *sftpConn) writeProgress(transfer *sftpTransfer, id string) {
+	progress := sftpMsg{
+		ID:    id,
+		Size:  transfer.size,
+		Bytes: transfer.bytes,
+	}
+
+	if err := s.write(ws.MessageSftpProgress, progress); err != nil {
+		log.Printf("sftp progress: %v", err)
+	}
+}
+
+func (s *sftpConn) writeErr(id string, err error) {
+	log.Printf("sftp: %v", err)
+
+	if wErr := s.write(ws.MessageSftpError, sftpMsg{ID: id, Error: err.Error()}); wErr != nil {
+		log.Printf("sftp ws write: %v", wErr)
+	}
+}
+
+func (s *sftpConn) write(msgType ws.MessageType, data sftpMsg) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	wsMsg := ws.Message{
+		Type: msgType,
+		Data: string(dataBytes),
+	}
+
+	return s.conn.WriteJSON(wsMsg)
+}
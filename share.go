@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	ws "github.com/sammy-t/ts-term/internal/websocket"
+	"tailscale.com/client/local"
+)
+
+// shareLink is the data of the session-share message
+// which the owner's browser builds the share link from.
+type shareLink struct {
+	Node  string `json:"node"`
+	Token string `json:"token"`
+}
+
+// viewerInfo describes a viewer in the owner's list of viewers.
+type viewerInfo struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Node    string `json:"node"`
+	Control bool   `json:"control"`
+}
+
+// controlMsg is the data of the session-control message.
+// The owner sets the control of the Viewer
+// and viewers are told whether they have control.
+type controlMsg struct {
+	Viewer  string `json:"viewer,omitempty"`
+	Control bool   `json:"control"`
+}
+
+// shareViewer is a tailnet user viewing a shared session.
+type shareViewer struct {
+	ID string
+	// Name is the login name of the viewer's Tailscale user.
+	Name string
+	// Node is the name of the viewer's Tailscale machine.
+	Node string
+	conn *ws.SyncedWebsocket
+	// control is whether the viewer's input is written to the session.
+	// It's guarded by the session's mutex.
+	control bool
+}
+
+// WriteJSON writes the message to the viewer.
+// A viewer which can't be written to is left for its handler to remove.
+func (v *shareViewer) WriteJSON(msg ws.Message) error {
+	if err := v.conn.WriteJSON(msg); err != nil {
+		log.Printf("viewer %q ws write: %v", v.Name, err)
+		return err
+	}
+
+	return nil
+}
+
+// Close disconnects the viewer with the reason.
+func (v *shareViewer) Close(reason string) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+
+	if err := v.conn.WriteMessage(websocket.CloseMessage, closeMsg); err != nil {
+		log.Printf("viewer %q ws close: %v", v.Name, err)
+	}
+
+	v.conn.Close()
+}
+
+// getShareHandler returns a handler streaming the output of the session in the `session` query param
+// to a viewer holding the session's share token in the `token` query param.
+// Any tailnet user with the share link is allowed
+// and the viewer's input is rejected unless the owner grants it control.
+func getShareHandler(client *local.Client, upgrader websocket.Upgrader, sessions *sessionStore) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("Received share request %q", r.URL.Path)
+
+		sess, ok := sessions.Get(r.URL.Query().Get("session"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		who, err := client.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil {
+			log.Printf("share ts who: %v", err)
+			http.Error(w, "unknown tailscale user", http.StatusForbidden)
+			return
+		}
+
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("share websocket: %v", err)
+			return
+		}
+
+		conn := &ws.SyncedWebsocket{
+			Conn: wsConn,
+			Mu:   &sync.Mutex{},
+		}
+		defer conn.Close()
+
+		viewer := &shareViewer{
+			ID:   uuid.NewString(),
+			Name: who.UserProfile.LoginName,
+			Node: who.Node.ComputedName,
+			conn: conn,
+		}
+
+		if err = sess.AddViewer(viewer, r.URL.Query().Get("token")); err != nil {
+			log.Printf("share %v: %v", sess.ID, err)
+
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid share link")
+			conn.WriteMessage(websocket.CloseMessage, closeMsg)
+			return
+		}
+		defer sess.RemoveViewer(viewer)
+
+		hub := ws.NewHandlerHub(conn, func(msg ws.Message) {
+			sess.HandleViewerMsg(viewer, msg)
+		})
+
+		ws.PingConn(conn, 3*time.Second)
+
+		<-hub.Closed
+	}
+
+	return h
+}
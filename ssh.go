@@ -1,146 +1,364 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"path"
-	"strings"
+	"slices"
 	"time"
 
+	"github.com/sammy-t/ts-term/internal/audit"
 	ws "github.com/sammy-t/ts-term/internal/websocket"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 	"tailscale.com/tsnet"
 )
 
-func getHostKeyCallback(conn *ws.SyncedWebsocket, knownHostsPath string) ssh.HostKeyCallback {
+// Host key decisions of the audit log.
+const (
+	hostKeyTrusted     = "trusted"
+	hostKeyCertTrusted = "cert-trusted"
+	hostKeyAccepted    = "accepted"
+	hostKeyRejected    = "rejected"
+	hostKeyMismatch    = "mismatch"
+)
+
+// getHostKeyCallback returns a callback which verifies host keys against
+// the known_hosts file and prompts the user to add unknown hosts.
+//
+// Host certificates are accepted when signed by a `@cert-authority` in the known_hosts file
+// or by a key in the host CA file. Otherwise, like OpenSSH, the certificate's
+// plain key is verified instead.
+//
+// Each decision is written to the audit log.
+func getHostKeyCallback(conn ws.SessionConn, knownHostsPath string, hostCAPath string) ssh.HostKeyCallback {
 	cb := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		hostKeyCb, err := knownhosts.New(knownHostsPath)
-		if err != nil {
-			return err
+		decision, err := verifyHostKey(conn, knownHostsPath, hostCAPath, hostname, remote, key)
+
+		auditLog.Log(audit.Event{
+			Type:        audit.EventHostKey,
+			Session:     conn.Session,
+			Host:        hostname,
+			Decision:    decision,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Error:       audit.ErrString(err),
+		})
+
+		return err
+	}
+
+	return cb
+}
+
+// verifyHostKey verifies the host key and returns the decision made.
+func verifyHostKey(conn ws.SessionConn, knownHostsPath string, hostCAPath string, hostname string, remote net.Addr, key ssh.PublicKey) (string, error) {
+	hostKeyCb, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return hostKeyRejected, err
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		certErr := hostKeyCb(hostname, remote, cert)
+		if certErr != nil && hostCAPath != "" {
+			certErr = checkHostCert(hostCAPath, hostname, remote, cert)
 		}
 
-		var keyErr *knownhosts.KeyError
+		if certErr == nil {
+			return hostKeyCertTrusted, nil
+		}
 
-		err = hostKeyCb(hostname, remote, key)
-		if err != nil && errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
-			log.Printf("key unknown: %v", keyErr)
+		log.Printf("host cert: %v", certErr)
+		key = cert.Key
+	}
 
-			wsMsg := ws.Message{
-				Type: ws.MessageSshHost,
-				Data: hostname,
-			}
+	var keyErr *knownhosts.KeyError
 
-			// Notify the user
-			if wsErr := conn.WriteJSON(wsMsg); wsErr != nil {
-				return fmt.Errorf("ws write: %w", wsErr)
-			}
+	err = hostKeyCb(hostname, remote, key)
+	if err == nil {
+		return hostKeyTrusted, nil
+	}
 
-			// Await a response
-			respMsg, respErr := ws.AwaitMsg(conn, ws.MessageSshHostAct, 1*time.Minute)
-			if respErr != nil {
-				log.Printf("host await msg: %v", respErr)
-				return errors.New("host await msg error")
-			}
+	if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		return hostKeyMismatch, err
+	}
 
-			if respMsg.Data == "yes" {
-				hostLine := knownhosts.Line([]string{hostname}, key)
+	log.Printf("key unknown: %v", keyErr)
 
-				file, fileErr := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if fileErr != nil {
-					log.Printf("file open: %v", fileErr)
-					return fileErr
-				}
-				defer file.Close()
+	wsMsg := ws.Message{
+		Type: ws.MessageSshHost,
+		Data: hostname,
+	}
 
-				if _, fileErr := file.WriteString(hostLine + "\n"); fileErr != nil {
-					return fileErr
-				}
+	// Notify the user
+	if wsErr := conn.WriteJSON(wsMsg); wsErr != nil {
+		return hostKeyRejected, fmt.Errorf("ws write: %w", wsErr)
+	}
 
-				hostKeyCb, err = knownhosts.New(knownHostsPath)
-				if err != nil {
-					return err
-				}
+	// Await a response
+	respMsg, respErr := conn.AwaitMsg(ws.MessageSshHostAct, 1*time.Minute)
+	if respErr != nil {
+		log.Printf("host await msg: %v", respErr)
+		return hostKeyRejected, errors.New("host await msg error")
+	}
 
-				// Retry with the updated known_hosts
-				err = hostKeyCb(hostname, remote, key)
-			}
-		}
+	if respMsg.Data != "yes" {
+		return hostKeyRejected, err
+	}
+
+	hostLine := knownhosts.Line([]string{hostname}, key)
 
+	file, fileErr := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if fileErr != nil {
+		log.Printf("file open: %v", fileErr)
+		return hostKeyRejected, fileErr
+	}
+	defer file.Close()
+
+	if _, fileErr := file.WriteString(hostLine + "\n"); fileErr != nil {
+		return hostKeyRejected, fileErr
+	}
+
+	hostKeyCb, err = knownhosts.New(knownHostsPath)
+	if err != nil {
+		return hostKeyRejected, err
+	}
+
+	// Retry with the updated known_hosts
+	if err = hostKeyCb(hostname, remote, key); err != nil {
+		return hostKeyRejected, err
+	}
+
+	return hostKeyAccepted, nil
+}
+
+// checkHostCert verifies the host certificate against the keys in the host CA file.
+func checkHostCert(hostCAPath string, hostname string, remote net.Addr, cert *ssh.Certificate) error {
+	caKeys, err := loadHostCAKeys(hostCAPath)
+	if err != nil {
 		return err
 	}
 
-	return cb
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return slices.ContainsFunc(caKeys, func(caKey ssh.PublicKey) bool {
+				return bytes.Equal(caKey.Marshal(), auth.Marshal())
+			})
+		},
+	}
+
+	return checker.CheckHostKey(hostname, remote, cert)
 }
 
-func reattemptSSH(r *http.Request, server *tsnet.Server, conn *ws.SyncedWebsocket, config *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
-	var sshErr error
+// loadHostCAKeys reads the CA public keys from the file
+// which uses the authorized_keys format.
+func loadHostCAKeys(hostCAPath string) ([]ssh.PublicKey, error) {
+	rest, err := os.ReadFile(hostCAPath)
+	if err != nil {
+		return nil, err
+	}
 
-	for range 5 {
-		log.Println("Reattempting ssh...")
+	caKeys := []ssh.PublicKey{}
+
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var caKey ssh.PublicKey
+
+		caKey, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("host ca keys: %w", err)
+		}
+
+		caKeys = append(caKeys, caKey)
+	}
+
+	return caKeys, nil
+}
+
+// dialSsh connects to the host through the tailnet.
+// If the config has jump hosts, the first jump host is dialed through the tailnet
+// and each following host is reached through a tunnel from the previous host.
+//
+// The jump host connections are closed once the returned client is closed.
+// Hosts the access policy denies aren't dialed.
+func dialSsh(ctx context.Context, server *tsnet.Server, conn ws.SessionConn, hostKeyCb ssh.HostKeyCallback, access *hostAccess, sshCfg SshConfig) (*ssh.Client, error) {
+	hosts := append(slices.Clone(sshCfg.JumpHosts), sshCfg.SshHost)
 
-		msg := ws.Message{
-			Type: ws.MessageSshErr,
+	// Check every host before connecting to any of them
+	for _, host := range hosts {
+		if err := access.Check(host); err != nil {
+			auditLog.Log(audit.Event{
+				Type:    audit.EventAccessDenied,
+				Session: conn.Session,
+				User:    access.User,
+				Host:    host.HostPort(),
+				SshUser: host.User,
+				Error:   err.Error(),
+			})
+
+			return nil, err
+		}
+	}
+
+	var clients []*ssh.Client
+
+	closeClients := func() {
+		for _, client := range slices.Backward(clients) {
+			client.Close()
+		}
+	}
+
+	for _, host := range hosts {
+		address := host.HostPort()
+
+		var netConn net.Conn
+		var err error
+
+		if len(clients) == 0 {
+			// Connect to the address through the tailnet
+			netConn, err = server.Dial(ctx, "tcp", address)
+		} else {
+			// Connect to the address through the previous host
+			netConn, err = clients[len(clients)-1].Dial("tcp", address)
 		}
 
-		if err := conn.WriteJSON(msg); err != nil {
-			return nil, nil, nil, fmt.Errorf("json msg: %w", err)
+		if err != nil {
+			closeClients()
+			return nil, fmt.Errorf("dial %v: %w", address, err)
 		}
 
-		respMsg, err := ws.AwaitMsg(conn, ws.MessageSshCfg, 1*time.Minute)
+		auth, err := getAuthMethods(conn, host, access)
 		if err != nil {
-			if sshErr != nil {
-				log.Printf("await msg: %v", err)
-				return nil, nil, nil, sshErr
-			}
-			return nil, nil, nil, err
+			netConn.Close()
+			closeClients()
+			return nil, fmt.Errorf("auth %v: %w", address, err)
 		}
 
-		sshCfg := parseSshConfig(respMsg.Data)
+		config := &ssh.ClientConfig{
+			User:            host.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCb,
+		}
+
+		// Create an SSH connection using the tailnet or tunneled connection
+		sshConn, newChan, reqs, err := ssh.NewClientConn(netConn, address, config)
+
+		authEvent := audit.Event{
+			Type:    audit.EventAuthSuccess,
+			Session: conn.Session,
+			Host:    address,
+			SshUser: host.User,
+		}
+
+		if err != nil {
+			authEvent.Type = audit.EventAuthFailure
+			authEvent.Error = err.Error()
+			auditLog.Log(authEvent)
+
+			netConn.Close()
+			closeClients()
+			return nil, fmt.Errorf("ssh %v: %w", address, err)
+		}
+
+		auditLog.Log(authEvent)
+
+		clients = append(clients, ssh.NewClient(sshConn, newChan, reqs))
+	}
+
+	sshClient := clients[len(clients)-1]
+
+	if len(clients) > 1 {
+		go func() {
+			sshClient.Wait()
+			closeClients()
+		}()
+	}
+
+	return sshClient, nil
+}
+
+// reattemptSSH prompts the user with the details of the SSH error
+// and reattempts the connection with the updated ssh config.
+// The ssh config is updated on success.
+func reattemptSSH(ctx context.Context, server *tsnet.Server, conn ws.SessionConn, hostKeyCb ssh.HostKeyCallback, access *hostAccess, sshCfg *SshConfig, sshErr error) (*ssh.Client, error) {
+	for range 5 {
+		log.Println("Reattempting ssh...")
+
+		if err := writeSshErr(conn, sshErr); err != nil {
+			return nil, err
+		}
 
-		config.User = sshCfg["username"]
-		config.Auth = []ssh.AuthMethod{
-			ssh.Password(sshCfg["password"]),
+		respMsg, err := conn.AwaitMsg(ws.MessageSshCfg, 1*time.Minute)
+		if err != nil {
+			if sshErr != nil {
+				log.Printf("await msg: %v", err)
+				return nil, sshErr
+			}
+			return nil, err
 		}
 
-		tsConn, err := server.Dial(r.Context(), "tcp", sshCfg["address"])
+		newCfg, err := parseSshConfig(respMsg.Data)
 		if err != nil {
-			return nil, nil, nil, fmt.Errorf("ts dial: %w", err)
+			log.Printf("ssh config: %v", err)
+			sshErr = err
+			continue
 		}
 
-		sshConn, newChan, reqs, err := ssh.NewClientConn(tsConn, sshCfg["address"], config)
+		sshClient, err := dialSsh(ctx, server, conn, hostKeyCb, access, newCfg)
 		if err != nil {
 			log.Printf("ssh reattempt: %v", err)
 			sshErr = err
 			continue
 		}
 
-		return sshConn, newChan, reqs, err
+		*sshCfg = newCfg
+
+		return sshClient, nil
 	}
 
-	return nil, nil, nil, errors.New("max ssh attempts reached")
+	return nil, errors.New("max ssh attempts reached")
 }
 
-func parseSshConfig(resp string) map[string]string {
-	// username:password:address:port
-	parsed := strings.Split(resp, ":")
+// writeSshErr notifies the user of the SSH error
+// so they can update the ssh config and reattempt.
+func writeSshErr(conn ws.SessionConn, sshErr error) error {
+	msg := ws.Message{
+		Type: ws.MessageSshErr,
+	}
+
+	if sshErr != nil {
+		msg.Data = sshErr.Error()
+	}
 
-	return map[string]string{
-		"username": parsed[0],
-		"password": parsed[1],
-		"address":  parsed[2] + ":" + parsed[3],
+	if err := conn.WriteJSON(msg); err != nil {
+		return fmt.Errorf("json msg: %w", err)
 	}
+
+	return nil
 }
 
-func getKnownHostsPath() (string, error) {
+// getSshDir returns the directory containing the ssh keys.
+func getSshDir() (string, error) {
+	if sshDir := os.Getenv("TS_TERM_SSH_DIR"); sshDir != "" {
+		return sshDir, nil
+	}
+
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
 
-	return path.Join(home, ".ssh", "known_hosts"), nil
+	return path.Join(home, ".ssh"), nil
+}
+
+func getKnownHostsPath() (string, error) {
+	sshDir, err := getSshDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(sshDir, "known_hosts"), nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// sshConfigVersion is the current version of the ssh-config message payload.
+const sshConfigVersion int = 1
+
+// SshConfig is the ssh-config message payload
+// describing the connection to a host.
+type SshConfig struct {
+	Version int `json:"version"`
+	SshHost
+	Options SshOptions `json:"options"`
+	// JumpHosts are tunneled through in order to reach the host.
+	JumpHosts []SshHost `json:"jumpHosts,omitempty"`
+}
+
+// SshHost describes a host and how to authenticate with it.
+type SshHost struct {
+	User    string  `json:"user"`
+	Auth    SshAuth `json:"auth"`
+	Address string  `json:"address"`
+	Port    int     `json:"port"`
+}
+
+// SshAuth describes how to authenticate with the host.
+//
+// Key is the name of a server key when using the "key" method
+// or the PEM encoded private key when using the "upload" method.
+// The "prompt" method prompts the user for the password while connecting.
+type SshAuth struct {
+	Method      string `json:"method"`
+	Password    string `json:"password,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Passphrase  string `json:"passphrase,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+type SshOptions struct {
+	ForwardAgent bool `json:"forwardAgent"`
+}
+
+// Validate checks that the config contains everything needed to connect.
+func (c SshConfig) Validate() error {
+	if c.Version != sshConfigVersion {
+		return fmt.Errorf("unsupported ssh config version %v", c.Version)
+	}
+
+	if err := c.SshHost.Validate(); err != nil {
+		return err
+	}
+
+	for i, jumpHost := range c.JumpHosts {
+		if err := jumpHost.Validate(); err != nil {
+			return fmt.Errorf("jump host %v: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// HostPort returns the address and port joined into a dialable address.
+func (h SshHost) HostPort() string {
+	return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+}
+
+// Validate checks that the host contains everything needed to connect.
+func (h SshHost) Validate() error {
+	if strings.TrimSpace(h.User) == "" {
+		return errors.New("username is required")
+	}
+
+	if strings.TrimSpace(h.Address) == "" {
+		return errors.New("address is required")
+	}
+
+	if h.Port < 1 || h.Port > 65535 {
+		return fmt.Errorf("port %v must be between 1 and 65535", h.Port)
+	}
+
+	switch h.Auth.Method {
+	case "password":
+		if h.Auth.Password == "" {
+			return errors.New("password is required")
+		}
+	case "key":
+		if h.Auth.Key == "" {
+			return errors.New("server key is required")
+		}
+	case "upload":
+		if strings.TrimSpace(h.Auth.Key) == "" {
+			return errors.New("private key is required")
+		}
+	case "prompt":
+		// The password is prompted for while connecting
+	default:
+		return fmt.Errorf("unknown auth method %q", h.Auth.Method)
+	}
+
+	return nil
+}
+
+// parseSshConfig parses and validates the ssh-config message data.
+//
+// Deprecated colon-delimited data is still accepted
+// but will be removed in a future release.
+func parseSshConfig(resp string) (SshConfig, error) {
+	var sshCfg SshConfig
+
+	resp = strings.TrimSpace(resp)
+
+	if strings.HasPrefix(resp, "{") {
+		if err := json.Unmarshal([]byte(resp), &sshCfg); err != nil {
+			return sshCfg, fmt.Errorf("invalid ssh config: %w", err)
+		}
+	} else {
+		log.Println("Deprecated: received a colon-delimited ssh config. Use the JSON ssh config instead.")
+
+		var err error
+
+		if sshCfg, err = parseLegacySshConfig(resp); err != nil {
+			return sshCfg, err
+		}
+	}
+
+	if err := sshCfg.Validate(); err != nil {
+		return sshCfg, fmt.Errorf("invalid ssh config: %w", err)
+	}
+
+	return sshCfg, nil
+}
+
+// parseLegacySshConfig parses the deprecated colon-delimited ssh config.
+func parseLegacySshConfig(resp string) (SshConfig, error) {
+	// username:password:address:port[:auth:key[:agent[:cert]]]
+	//
+	// The password doubles as the key passphrase when using key auth
+	// and uploaded keys and certificates are base64 encoded.
+	parsed := strings.Split(resp, ":")
+
+	if len(parsed) < 4 {
+		return SshConfig{}, errors.New("invalid ssh config: expected username:password:address:port")
+	}
+
+	port, err := strconv.Atoi(parsed[3])
+	if err != nil {
+		return SshConfig{}, fmt.Errorf("invalid ssh config: port %q", parsed[3])
+	}
+
+	sshCfg := SshConfig{
+		Version: sshConfigVersion,
+		SshHost: SshHost{
+			User: parsed[0],
+			Auth: SshAuth{
+				Method:   "password",
+				Password: parsed[1],
+			},
+			Address: parsed[2],
+			Port:    port,
+		},
+	}
+
+	if len(parsed) >= 6 && parsed[4] != "" && parsed[4] != "password" {
+		sshCfg.Auth = SshAuth{
+			Method:     parsed[4],
+			Key:        parsed[5],
+			Passphrase: parsed[1],
+		}
+	}
+
+	if len(parsed) >= 7 {
+		sshCfg.Options.ForwardAgent = parsed[6] == "true"
+	}
+
+	if len(parsed) >= 8 {
+		sshCfg.Auth.Certificate = parsed[7]
+	}
+
+	if sshCfg.Auth.Method == "upload" {
+		keyBytes, err := base64.StdEncoding.DecodeString(sshCfg.Auth.Key)
+		if err != nil {
+			return SshConfig{}, fmt.Errorf("invalid ssh config: decode key: %w", err)
+		}
+
+		certBytes, err := base64.StdEncoding.DecodeString(sshCfg.Auth.Certificate)
+		if err != nil {
+			return SshConfig{}, fmt.Errorf("invalid ssh config: decode cert: %w", err)
+		}
+
+		sshCfg.Auth.Key = string(keyBytes)
+		sshCfg.Auth.Certificate = string(certBytes)
+	}
+
+	return sshCfg, nil
+}
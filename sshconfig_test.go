@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSshConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    SshConfig
+		wantErr bool
+	}{
+		{name: "empty", data: "", wantErr: true},
+		{name: "user only", data: "alice", wantErr: true},
+		{name: "missing address", data: "alice:secret", wantErr: true},
+		{name: "missing port", data: "alice:secret:host", wantErr: true},
+		{name: "legacy bad port", data: "alice:secret:host:ssh", wantErr: true},
+		{name: "legacy port out of range", data: "alice:secret:host:0", wantErr: true},
+		{
+			name: "legacy",
+			data: "alice:secret:host:22",
+			want: SshConfig{
+				Version: sshConfigVersion,
+				SshHost: SshHost{
+					User:    "alice",
+					Auth:    SshAuth{Method: "password", Password: "secret"},
+					Address: "host",
+					Port:    22,
+				},
+			},
+		},
+		{
+			name: "colons in password",
+			data: `{"version":1,"user":"alice","auth":{"method":"password","password":"s:e:c"},"address":"host","port":22}`,
+			want: SshConfig{
+				Version: sshConfigVersion,
+				SshHost: SshHost{
+					User:    "alice",
+					Auth:    SshAuth{Method: "password", Password: "s:e:c"},
+					Address: "host",
+					Port:    22,
+				},
+			},
+		},
+		{
+			name: "ipv6 address",
+			data: `{"version":1,"user":"alice","auth":{"method":"prompt"},"address":"fd7a:115c:a1e0::1","port":2222}`,
+			want: SshConfig{
+				Version: sshConfigVersion,
+				SshHost: SshHost{
+					User:    "alice",
+					Auth:    SshAuth{Method: "prompt"},
+					Address: "fd7a:115c:a1e0::1",
+					Port:    2222,
+				},
+			},
+		},
+		{name: "bad port", data: `{"version":1,"user":"alice","auth":{"method":"prompt"},"address":"host","port":65536}`, wantErr: true},
+		{name: "missing version", data: `{"user":"alice","auth":{"method":"prompt"},"address":"host","port":22}`, wantErr: true},
+		{name: "unknown version", data: `{"version":2,"user":"alice","auth":{"method":"prompt"},"address":"host","port":22}`, wantErr: true},
+		{name: "unknown auth method", data: `{"version":1,"user":"alice","auth":{"method":"magic"},"address":"host","port":22}`, wantErr: true},
+		{name: "invalid json", data: `{"version":1,`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSshConfig(tt.data)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSshConfig(%q) = %+v, want an error", tt.data, got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseSshConfig(%q): %v", tt.data, err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSshConfig(%q) = %+v, want %+v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSshHostHostPort(t *testing.T) {
+	tests := []struct {
+		host SshHost
+		want string
+	}{
+		{host: SshHost{Address: "host", Port: 22}, want: "host:22"},
+		{host: SshHost{Address: "100.64.0.1", Port: 2222}, want: "100.64.0.1:2222"},
+		{host: SshHost{Address: "fd7a:115c:a1e0::1", Port: 22}, want: "[fd7a:115c:a1e0::1]:22"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.host.HostPort(); got != tt.want {
+			t.Errorf("%+v.HostPort() = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"tailscale.com/ipn"
+)
+
+// encryptedStore is a node state store kept in a file encrypted with AES-GCM.
+// The node's keys are in its state so the file is unreadable without the state key.
+type encryptedStore struct {
+	filePath string
+	aead     cipher.AEAD
+	state    map[ipn.StateKey][]byte
+	mu       *sync.Mutex
+}
+
+// newEncryptedStore opens the store in the file, decrypting it with the 32 byte key.
+// The file is created on the first write.
+func newEncryptedStore(filePath string, key []byte) (*encryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("gcm: %w", err)
+	}
+
+	s := &encryptedStore{
+		filePath: filePath,
+		aead:     aead,
+		state:    make(map[ipn.StateKey][]byte),
+		mu:       &sync.Mutex{},
+	}
+
+	sealed, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("state file is truncated")
+	}
+
+	stateBytes, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+
+	if err = json.Unmarshal(stateBytes, &s.state); err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *encryptedStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, ok := s.state[id]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+
+	return bs, nil
+}
+
+// WriteState saves the state and rewrites the file.
+// Nil state is deleted.
+func (s *encryptedStore) WriteState(id ipn.StateKey, bs []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bs == nil {
+		delete(s.state, id)
+	} else {
+		s.state[id] = bs
+	}
+
+	stateBytes, err := json.Marshal(s.state)
+	if err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return fmt.Errorf("nonce: %w", err)
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, stateBytes, nil)
+
+	// Replace the file at once so a crash doesn't leave it partially written
+	tmpPath := path.Join(path.Dir(s.filePath), "."+path.Base(s.filePath)+".tmp")
+
+	if err = os.WriteFile(tmpPath, sealed, 0600); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err = os.Rename(tmpPath, s.filePath); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	filePath := filepath.Join(t.TempDir(), "tailscaled.state.enc")
+
+	store, err := newEncryptedStore(filePath, key)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	if _, err = store.ReadState("_machinekey"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Fatalf("ReadState before a write = %v, want ErrStateNotExist", err)
+	}
+
+	state := []byte("privkey:secret-machine-key")
+
+	if err = store.WriteState("_machinekey", state); err != nil {
+		t.Fatalf("WriteState: %v", err)
+	}
+
+	sealed, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+
+	if bytes.Contains(sealed, state) {
+		t.Error("the state file contains the plaintext state")
+	}
+
+	// Reopening decrypts the file written by the previous store
+	reopened, err := newEncryptedStore(filePath, key)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+
+	got, err := reopened.ReadState("_machinekey")
+	if err != nil {
+		t.Fatalf("ReadState: %v", err)
+	}
+
+	if !bytes.Equal(got, state) {
+		t.Errorf("ReadState = %q, want %q", got, state)
+	}
+
+	// Nil state is deleted
+	if err = reopened.WriteState("_machinekey", nil); err != nil {
+		t.Fatalf("WriteState nil: %v", err)
+	}
+
+	if _, err = reopened.ReadState("_machinekey"); !errors.Is(err, ipn.ErrStateNotExist) {
+		t.Errorf("ReadState after deleting = %v, want ErrStateNotExist", err)
+	}
+}
+
+func TestEncryptedStoreOpenErrors(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	wrongKey := make([]byte, 32)
+	rand.Read(wrongKey)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "tailscaled.state.enc")
+
+	store, err := newEncryptedStore(filePath, key)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+
+	if err = store.WriteState("_machinekey", []byte("secret")); err != nil {
+		t.Fatalf("WriteState: %v", err)
+	}
+
+	sealed, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tamperedPath := filepath.Join(dir, "tampered.enc")
+	truncatedPath := filepath.Join(dir, "truncated.enc")
+
+	os.WriteFile(tamperedPath, tampered, 0600)
+	os.WriteFile(truncatedPath, sealed[:4], 0600)
+
+	tests := []struct {
+		name     string
+		filePath string
+		key      []byte
+	}{
+		{name: "wrong key", filePath: filePath, key: wrongKey},
+		{name: "tampered", filePath: tamperedPath, key: key},
+		{name: "truncated", filePath: truncatedPath, key: key},
+		{name: "invalid key size", filePath: filePath, key: key[:10]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newEncryptedStore(tt.filePath, tt.key); err == nil {
+				t.Error("newEncryptedStore succeeded, want an error")
+			}
+		})
+	}
+}
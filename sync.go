@@ -19,8 +19,8 @@ type winSize struct {
 
 const ioDelay time.Duration = 10 * time.Millisecond
 
-// ptyToWs reads PTY error output and writes it to the WebSocket.
-func ptyErrToWs(errPipe io.Reader, conn *ws.SyncedWebsocket, onClosed func()) {
+// ptyErrToWs reads PTY error output and writes it to the WebSocket and the recording.
+func ptyErrToWs(errPipe io.Reader, conn msgWriter, rec *recorder, onClosed func()) {
 	log.Println("Reading pty err...")
 
 	defer func() {
@@ -35,30 +35,34 @@ func ptyErrToWs(errPipe io.Reader, conn *ws.SyncedWebsocket, onClosed func()) {
 		time.Sleep(ioDelay)
 
 		n, err := errPipe.Read(b)
-		if err != nil && n > 0 {
-			log.Printf("read err: %v", err)
-			return
-		}
 
-		if n == 0 {
-			continue
-		}
+		if n > 0 {
+			msg := ws.Message{
+				Type: ws.MessageOutput,
+				Data: string(b[:n]),
+			}
 
-		msg := ws.Message{
-			Type: ws.MessageOutput,
-			Data: string(b[:n]),
+			rec.Output(b[:n])
+
+			// log.Printf("read err [%d] %q", n, b[:n])
+			if err := conn.WriteJSON(msg); err != nil {
+				log.Printf("ws write: %v", err)
+				return
+			}
 		}
 
-		// log.Printf("read err [%d] %q", n, b[:n])
-		if err = conn.WriteJSON(msg); err != nil {
-			log.Printf("ws write: %v", err)
+		// The pipe returns io.EOF once the session ends
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("read err: %v", err)
+			}
 			return
 		}
 	}
 }
 
-// ptyToWs reads PTY output and writes it to the WebSocket.
-func ptyToWs(outPipe io.Reader, conn *ws.SyncedWebsocket, onClosed func()) {
+// ptyToWs reads PTY output and writes it to the WebSocket and the recording.
+func ptyToWs(outPipe io.Reader, conn msgWriter, rec *recorder, onClosed func()) {
 	log.Println("Reading pty...")
 
 	defer func() {
@@ -73,66 +77,62 @@ func ptyToWs(outPipe io.Reader, conn *ws.SyncedWebsocket, onClosed func()) {
 		time.Sleep(ioDelay)
 
 		n, err := outPipe.Read(b)
-		if err != nil && n > 0 {
-			log.Printf("read: %v", err)
-			return
-		}
 
-		if n == 0 {
-			continue
-		}
+		if n > 0 {
+			msg := ws.Message{
+				Type: ws.MessageOutput,
+				Data: string(b[:n]),
+			}
 
-		msg := ws.Message{
-			Type: ws.MessageOutput,
-			Data: string(b[:n]),
+			rec.Output(b[:n])
+
+			// log.Printf("read [%d] %q", n, b[:n])
+			if err := conn.WriteJSON(msg); err != nil {
+				log.Printf("ws write: %v", err)
+				return
+			}
 		}
 
-		// log.Printf("read [%d] %q", n, b[:n])
-		if err = conn.WriteJSON(msg); err != nil {
-			log.Printf("ws write: %v", err)
+		// The pipe returns io.EOF once the session ends
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("read: %v", err)
+			}
 			return
 		}
 	}
 }
 
-// wsToPty reads WebSocket input and writes it to the PTY.
-func wsToPty(inPipe io.WriteCloser, session *ssh.Session, conn *ws.SyncedWebsocket, onClosed func()) {
-	log.Println("Reading websocket...")
-
-	defer func() {
-		if onClosed != nil {
-			onClosed()
+// wsToPty writes WebSocket input to the PTY.
+// Input and size changes are recorded according to the recording policy.
+// Port forward messages are passed to the forwarder.
+func wsToPty(msg ws.Message, inPipe io.Writer, session *ssh.Session, fwd *forwarder, rec *recorder) {
+	switch msg.Type {
+	case ws.MessageInput:
+		rec.Input(msg.Data)
+
+		// log.Printf("ws text: %v, %q", msg.Type, msg.Data)
+		if n, err := inPipe.Write([]byte(msg.Data)); err != nil {
+			log.Printf("ws write: [%v] %v", n, err)
 		}
-	}()
-
-	for {
-		var msg ws.Message
+	case ws.MessageSize:
+		log.Printf("size %v", msg.Data)
 
-		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("Websocket read: %v", err)
-			return
+		var size winSize
+		if err := json.Unmarshal([]byte(msg.Data), &size); err != nil {
+			log.Printf("size: %v", err)
+			break
 		}
 
-		switch msg.Type {
-		case ws.MessageInput:
-			// log.Printf("ws text: %v, %q", msg.Type, msg.Data)
-			if n, err := inPipe.Write([]byte(msg.Data)); err != nil {
-				log.Printf("ws write: [%v] %v", n, err)
-			}
-		case ws.MessageSize:
-			log.Printf("size %v", msg.Data)
-
-			var size winSize
-			if err := json.Unmarshal([]byte(msg.Data), &size); err != nil {
-				log.Printf("size: %v", err)
-				break
-			}
-
-			if err := session.WindowChange(size.Rows, size.Cols); err != nil {
-				log.Printf("set size: %v", err)
-			}
-		default:
-			log.Printf("ws type: %v, data: %q", msg.Type, msg.Data)
+		if err := session.WindowChange(size.Rows, size.Cols); err != nil {
+			log.Printf("set size: %v", err)
+			break
 		}
+
+		rec.Resize(size.Cols, size.Rows)
+	case ws.MessageForwardAdd, ws.MessageForwardRemove:
+		fwd.HandleMsg(msg)
+	default:
+		log.Printf("ws type: %v, data: %q", msg.Type, msg.Data)
 	}
 }
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"slices"
 	"strings"
 	"time"
@@ -14,14 +18,35 @@
 	"github.com/gorilla/websocket"
 	ws "github.com/sammy-t/ts-term/internal/websocket"
 	"tailscale.com/client/local"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tsnet"
 )
 
+// sshProbeTimeout bounds probing the peers' SSH ports so the peer list isn't held up.
+const sshProbeTimeout time.Duration = 3 * time.Second
+
+// sshProbeLimit is the number of peers probed at once.
+const sshProbeLimit int = 16
+
+// PeerConnInfo describes a tailnet machine in the connection dialog's machine list.
 type PeerConnInfo struct {
+	ID          string   `json:"id"`
 	Domain      string   `json:"domain"`
 	ShortDomain string   `json:"shortDomain"`
 	Ips         []string `json:"ips"`
+	Online      bool     `json:"online"`
+	// LastSeen is when an offline machine was last connected to the tailnet.
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	OS       string     `json:"os"`
+	Tags     []string   `json:"tags"`
+	// Owner is the login name of the machine's user. It's empty for tagged machines.
+	Owner string `json:"owner"`
+	// TailscaleSsh is whether the machine runs Tailscale SSH.
+	TailscaleSsh bool `json:"tailscaleSsh"`
+	// SshReachable is whether port 22 accepted a connection.
+	// It's nil if the machine is offline or the probe timed out.
+	SshReachable *bool `json:"sshReachable"`
 }
 
 func createHostName() string {
@@ -108,6 +133,18 @@ func pollStatus(r *http.Request, server *tsnet.Server, client *local.Client, hub
 // createUpgraderTs creates a WebSocket Upgrader with a CheckOrigin function
 // that verifies requests against the provided Tailscale server.
 func createUpgraderTs(client *local.Client) websocket.Upgrader {
+	tsUpgrader := websocket.Upgrader{
+		ReadBufferSize:  bufferSize,
+		WriteBufferSize: bufferSize,
+		CheckOrigin:     createOriginCheckTs(client),
+	}
+
+	return tsUpgrader
+}
+
+// createOriginCheckTs creates a function which verifies
+// the request's origin is the provided Tailscale server or one of its peers.
+func createOriginCheckTs(client *local.Client) func(r *http.Request) bool {
 	checkOrigin := func(r *http.Request) bool {
 		if dev {
 			return true
@@ -137,13 +174,7 @@ func createUpgraderTs(client *local.Client) websocket.Upgrader {
 		return host == origin || slices.Contains(validOriginHosts, origin)
 	}
 
-	tsUpgrader := websocket.Upgrader{
-		ReadBufferSize:  bufferSize,
-		WriteBufferSize: bufferSize,
-		CheckOrigin:     checkOrigin,
-	}
-
-	return tsUpgrader
+	return checkOrigin
 }
 
 // getValidHosts returns all the Tailscale domains and IP addresses
@@ -174,12 +205,23 @@ func getValidHosts(status *ipnstate.Status) []string {
 	return addresses
 }
 
-func getPeerConnInfo(r *http.Request, client *local.Client) ([]PeerConnInfo, error) {
+// getPeerConnInfo returns the tailnet's machines
+// and probes the online machines' SSH port through the node.
+func getPeerConnInfo(r *http.Request, server *tsnet.Server, client *local.Client) ([]PeerConnInfo, error) {
 	status, err := client.Status(r.Context())
 	if err != nil {
 		return nil, fmt.Errorf("ts status %q: %w", status.BackendState, err)
 	}
 
+	infos := peerConnInfos(status)
+
+	probeSsh(r.Context(), server, infos)
+
+	return infos, nil
+}
+
+// peerConnInfos describes the status's peers.
+func peerConnInfos(status *ipnstate.Status) []PeerConnInfo {
 	infos := []PeerConnInfo{}
 
 	for _, peerStatus := range status.Peer {
@@ -194,13 +236,215 @@ func getPeerConnInfo(r *http.Request, client *local.Client) ([]PeerConnInfo, err
 		}
 
 		info := PeerConnInfo{
-			Domain:      domain,
-			ShortDomain: shortDomain,
-			Ips:         ips,
+			ID:           string(peerStatus.ID),
+			Domain:       domain,
+			ShortDomain:  shortDomain,
+			Ips:          ips,
+			Online:       peerStatus.Online,
+			OS:           peerStatus.OS,
+			Tags:         []string{},
+			TailscaleSsh: len(peerStatus.SSH_HostKeys) > 0,
+		}
+
+		if !peerStatus.Online && !peerStatus.LastSeen.IsZero() {
+			lastSeen := peerStatus.LastSeen
+			info.LastSeen = &lastSeen
+		}
+
+		if peerStatus.Tags != nil && peerStatus.Tags.Len() > 0 {
+			info.Tags = peerStatus.Tags.AsSlice()
+		} else if user, ok := status.User[peerStatus.UserID]; ok {
+			info.Owner = user.LoginName
 		}
 
 		infos = append(infos, info)
 	}
 
-	return infos, nil
+	return infos
+}
+
+// probeSsh sets whether the online machines accept connections on port 22.
+// Machines already probed are skipped and machines not probed before the timeout are left unknown.
+func probeSsh(ctx context.Context, server *tsnet.Server, infos []PeerConnInfo) {
+	ctx, cancel := context.WithTimeout(ctx, sshProbeTimeout)
+	defer cancel()
+
+	limit := make(chan struct{}, sshProbeLimit)
+	done := make(chan struct{})
+
+	probing := 0
+
+	for i := range infos {
+		if !infos[i].Online || len(infos[i].Ips) == 0 || infos[i].SshReachable != nil {
+			continue
+		}
+
+		probing++
+
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+			case <-ctx.Done():
+				return
+			}
+
+			conn, err := server.Dial(ctx, "tcp", net.JoinHostPort(infos[i].Ips[0], "22"))
+			if err == nil {
+				conn.Close()
+			} else if ctx.Err() != nil {
+				return
+			}
+
+			reachable := err == nil
+			infos[i].SshReachable = &reachable
+		}()
+	}
+
+	for range probing {
+		<-done
+	}
+}
+
+// watchPeers pushes the tailnet's machines to the WebSocket
+// followed by the machines added, updated and removed
+// as the node's IPN bus reports peer changes until the context is done.
+func watchPeers(ctx context.Context, server *tsnet.Server, client *local.Client, conn *ws.SyncedWebsocket) error {
+	watcher, err := client.WatchIPNBus(ctx, ipn.NotifyPeerChanges|ipn.NotifyNoNetMap|ipn.NotifyRateLimit)
+	if err != nil {
+		return fmt.Errorf("watch ipn bus: %w", err)
+	}
+	defer watcher.Close()
+
+	// The browser's machine list is replaced once the watch starts
+	// so no change between the init WebSocket's list and the watch is missed.
+	status, err := client.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("ts status: %w", err)
+	}
+
+	infos := peerConnInfos(status)
+	probeSsh(ctx, server, infos)
+
+	if err = writePeerMsg(conn, ws.MessagePeers, infos); err != nil {
+		return err
+	}
+
+	known := make(map[string]PeerConnInfo, len(infos))
+
+	for _, info := range infos {
+		known[info.ID] = info
+	}
+
+	for {
+		notify, err := watcher.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("ipn bus: %w", err)
+		}
+
+		if len(notify.PeersChanged) == 0 && len(notify.PeersRemoved) == 0 && notify.NetMap == nil {
+			continue
+		}
+
+		status, err := client.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("ts status: %w", err)
+		}
+
+		if err = writePeerChanges(ctx, server, conn, known, peerConnInfos(status)); err != nil {
+			return err
+		}
+	}
+}
+
+// writePeerChanges writes the difference between the known machines and the current machines
+// to the WebSocket and updates the known machines.
+// Machines which were added or came online are probed for SSH.
+func writePeerChanges(ctx context.Context, server *tsnet.Server, conn *ws.SyncedWebsocket, known map[string]PeerConnInfo, infos []PeerConnInfo) error {
+	var added, updated []PeerConnInfo
+	current := make(map[string]bool, len(infos))
+
+	for _, info := range infos {
+		current[info.ID] = true
+
+		prev, ok := known[info.ID]
+		if !ok {
+			added = append(added, info)
+			continue
+		}
+
+		// Keep the previous probe while the machine stays online
+		if prev.Online && info.Online {
+			info.SshReachable = prev.SshReachable
+		}
+
+		if !reflect.DeepEqual(prev, info) {
+			updated = append(updated, info)
+		}
+	}
+
+	changed := slices.Concat(added, updated)
+	probeSsh(ctx, server, changed)
+
+	added, updated = changed[:len(added)], changed[len(added):]
+
+	for _, info := range added {
+		known[info.ID] = info
+
+		if err := writePeerMsg(conn, ws.MessagePeerAdd, info); err != nil {
+			return err
+		}
+	}
+
+	for _, info := range updated {
+		known[info.ID] = info
+
+		if err := writePeerMsg(conn, ws.MessagePeerUpdate, info); err != nil {
+			return err
+		}
+	}
+
+	for id := range known {
+		if current[id] {
+			continue
+		}
+
+		delete(known, id)
+
+		wsMsg := ws.Message{
+			Type: ws.MessagePeerRemove,
+			Data: id,
+		}
+
+		if err := conn.WriteJSON(wsMsg); err != nil {
+			return fmt.Errorf("ws write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writePeerMsg writes the machine or machines as the message type's data.
+func writePeerMsg(conn *ws.SyncedWebsocket, msgType ws.MessageType, v any) error {
+	infoBytes, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("peers marshal: %w", err)
+	}
+
+	wsMsg := ws.Message{
+		Type: msgType,
+		Data: string(infoBytes),
+	}
+
+	if err = conn.WriteJSON(wsMsg); err != nil {
+		return fmt.Errorf("ws write: %w", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"tailscale.com/tsnet"
+)
+
+// startUiNode joins the tailnet as the persistent node serving the ts-term UI.
+// The node's state is kept in the state dir so it keeps its name and identity across restarts.
+//
+// Until the node is logged in, the login URL is written to the log
+// unless the enroller logs it in.
+func startUiNode(ctx context.Context, hostname string, enroll *enroller) (*tsnet.Server, error) {
+	dir, err := getStateDir()
+	if err != nil {
+		return nil, fmt.Errorf("state dir: %w", err)
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	server := &tsnet.Server{
+		Hostname:   hostname,
+		Dir:        dir,
+		ControlURL: os.Getenv("TS_CONTROL_URL"),
+	}
+
+	if err = enroll.Configure(ctx, server); err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+
+	log.Printf("Starting ts-term node %q...", hostname)
+
+	if _, err = server.Up(ctx); err != nil {
+		server.Close()
+		return nil, fmt.Errorf("up: %w", err)
+	}
+
+	return server, nil
+}
+
+// serveUiNode serves the handler over HTTPS on the node
+// with a certificate for the node's tailnet domain
+// and redirects HTTP requests to HTTPS.
+func serveUiNode(server *tsnet.Server, handler http.Handler) error {
+	domains := server.CertDomains()
+	if len(domains) == 0 {
+		return errors.New("HTTPS certificates must be enabled in the admin panel")
+	}
+
+	httpListener, err := server.Listen("tcp", ":80")
+	if err != nil {
+		return fmt.Errorf("listen http: %w", err)
+	}
+	defer httpListener.Close()
+
+	listener, err := server.ListenTLS("tcp", ":443")
+	if err != nil {
+		return fmt.Errorf("listen tls: %w", err)
+	}
+	defer listener.Close()
+
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://"+domains[0]+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+
+	go func() {
+		err := http.Serve(httpListener, http.HandlerFunc(redirect))
+		log.Printf("http redirect closed: %v", err)
+	}()
+
+	log.Printf("Serving ts-term on https://%v", domains[0])
+
+	return http.Serve(listener, handler)
+}
+
+// getUiHostname returns the name of the persistent node serving the UI
+// or an empty string if the UI is served on TS_TERM_ADDR.
+func getUiHostname() string {
+	return os.Getenv("TS_TERM_HOSTNAME")
+}
+
+// getStateDir returns the directory the UI node's state is kept in.
+func getStateDir() (string, error) {
+	if stateDir := os.Getenv("TS_TERM_STATE_DIR"); stateDir != "" {
+		return stateDir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(home, ".ts-term", "node"), nil
+}
@@ -0,0 +1,449 @@
+/**
+ * @typedef {Object} WsMessage
+ * @property {String} type
+ * @property {String} data
+ */
+
+/**
+ * @typedef {Object} SftpEntry
+ * @property {String} name
+ * @property {Number} size
+ * @property {String} mode
+ * @property {String} modTime
+ * @property {Boolean} isDir
+ */
+
+/**
+ * @typedef {Object} SftpMsg
+ * @property {String} [id]
+ * @property {String} [path]
+ * @property {Number} [size]
+ * @property {Number} [bytes]
+ * @property {String} [data] base64 encoded file chunk
+ * @property {Array<SftpEntry>} [entries]
+ * @property {String} [error]
+ */
+
+/**
+ * @typedef {Object} Transfer
+ * @property {String} name
+ * @property {Boolean} upload
+ * @property {Number} size
+ * @property {Number} bytes
+ * @property {File} [file]
+ * @property {Array<Uint8Array>} [chunks]
+ * @property {HTMLLIElement} el
+ */
+
+const chunkSize = 32 * 1024;
+
+/** @type {HTMLElement} */
+const filesView = document.querySelector('#files');
+
+/** @type {HTMLFormElement} */
+const pathForm = filesView.querySelector('form.path');
+
+/** @type {HTMLInputElement} */
+const pathInput = pathForm.querySelector('input[name="path"]');
+
+/** @type {HTMLUListElement} */
+const entriesList = filesView.querySelector('.entries');
+
+/** @type {HTMLDivElement} */
+const dropZone = filesView.querySelector('.drop-zone');
+
+/** @type {HTMLUListElement} */
+const transfersList = filesView.querySelector('.transfers');
+
+/** @type {WebSocket} */
+let sftpWs;
+
+/**
+ * The id of the session the SFTP WebSocket uses.
+ * @type {String}
+ */
+let sftpSession;
+
+let cwd = '';
+
+/** @type {Map<String, Transfer>} */
+const transfers = new Map();
+
+/**
+ * Connects to the SFTP WebSocket of the Tailscale node
+ * and lists the working directory.
+ * An open WebSocket of another session is closed first.
+ * @param {String} url The Tailscale WebSocket url.
+ * @param {String} session The id of the session to browse.
+ */
+export function connectSftpWs(url, session) {
+	if(sftpWs && sftpWs.readyState <= WebSocket.OPEN) {
+		if(sftpSession === session) return;
+
+		closeSftpWs();
+	}
+
+	const ws = new WebSocket(`${url}/sftp?session=${encodeURIComponent(session)}`);
+
+	sftpWs = ws;
+	sftpSession = session;
+
+	ws.onopen = () => listDir('');
+
+	ws.onmessage = (ev) => {
+		if(ws !== sftpWs) return;
+
+		/** @type {WsMessage} */
+		const msg = JSON.parse(ev.data);
+
+		/** @type {SftpMsg} */
+		const data = JSON.parse(msg.data);
+
+		switch(msg.type) {
+			case 'sftp-list':
+				updateEntries(data);
+				break;
+
+			case 'sftp-chunk':
+				onChunk(data);
+				break;
+
+			case 'sftp-progress':
+				onProgress(data);
+				break;
+
+			case 'sftp-done':
+				onDone(data);
+				break;
+
+			case 'sftp-error':
+				onError(data);
+				break;
+		}
+	};
+
+	ws.onclose = (ev) => {
+		console.log(ev);
+
+		if(ws !== sftpWs) return;
+
+		resetFiles();
+	};
+}
+
+/**
+ * Closes the SFTP WebSocket and fails its transfers.
+ */
+export function closeSftpWs() {
+	const ws = sftpWs;
+
+	sftpWs = undefined;
+	sftpSession = undefined;
+
+	resetFiles();
+	ws?.close();
+}
+
+function resetFiles() {
+	transfers.forEach((transfer, id) => onError({ id, error: 'connection closed' }));
+	entriesList.replaceChildren();
+}
+
+/**
+ * @param {String} type
+ * @param {SftpMsg} data
+ */
+function send(type, data) {
+	if(sftpWs?.readyState !== WebSocket.OPEN) return;
+
+	/** @type {WsMessage} */
+	const msg = {
+		type,
+		data: JSON.stringify(data),
+	};
+
+	sftpWs.send(JSON.stringify(msg));
+}
+
+/**
+ * @param {String} path
+ */
+function listDir(path) {
+	send('sftp-list', { path });
+}
+
+/**
+ * @param {String} dir
+ * @param {String} name
+ */
+function joinPath(dir, name) {
+	return (dir.endsWith('/')) ? `${dir}${name}` : `${dir}/${name}`;
+}
+
+/**
+ * @param {Number} bytes
+ */
+function formatSize(bytes) {
+	const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+
+	let size = bytes;
+	let unit = 0;
+
+	while(size >= 1024 && unit < units.length - 1) {
+		size /= 1024;
+		unit++;
+	}
+
+	return `${size.toFixed((unit === 0) ? 0 : 1)} ${units[unit]}`;
+}
+
+/**
+ * @param {SftpMsg} data
+ */
+function updateEntries(data) {
+	cwd = data.path;
+	pathInput.value = cwd;
+
+	const entries = data.entries ?? [];
+	entries.sort((a, b) => (b.isDir - a.isDir) || a.name.localeCompare(b.name));
+
+	entriesList.replaceChildren();
+
+	entries.forEach((entry) => {
+		const item = document.createElement('li');
+		item.title = `${entry.mode} ${new Date(entry.modTime).toLocaleString()}`;
+
+		const name = document.createElement('span');
+		name.innerText = (entry.isDir) ? `${entry.name}/` : entry.name;
+		name.className = (entry.isDir) ? 'dir' : '';
+
+		const size = document.createElement('span');
+		size.innerText = (entry.isDir) ? '' : formatSize(entry.size);
+
+		item.append(name, size);
+
+		item.addEventListener('click', () => {
+			const path = joinPath(cwd, entry.name);
+
+			if(entry.isDir) {
+				listDir(path);
+				return;
+			}
+
+			startDownload(path, entry.name);
+		});
+
+		entriesList.append(item);
+	});
+}
+
+/**
+ * @param {String} name
+ * @param {Boolean} upload
+ * @param {Number} size
+ * @returns {String} The transfer id.
+ */
+function addTransfer(name, upload, size) {
+	const id = crypto.randomUUID();
+
+	const el = document.createElement('li');
+
+	const label = document.createElement('span');
+	label.innerText = `${(upload) ? '↑' : '↓'} ${name}`;
+
+	const progress = document.createElement('progress');
+	progress.max = size || 1;
+	progress.value = 0;
+
+	const cancel = document.createElement('button');
+	cancel.innerText = 'Cancel';
+	cancel.addEventListener('click', () => {
+		if(transfers.has(id)) {
+			send('sftp-cancel', { id });
+			return;
+		}
+
+		el.remove();
+	});
+
+	el.append(label, progress, cancel);
+	transfersList.append(el);
+
+	transfers.set(id, { name, upload, size, bytes: 0, el });
+
+	return id;
+}
+
+/**
+ * @param {String} id
+ * @param {String} status
+ */
+function finishTransfer(id, status) {
+	const transfer = transfers.get(id);
+	if(!transfer) return;
+
+	transfers.delete(id);
+
+	transfer.el.querySelector('span').innerText += ` (${status})`;
+	transfer.el.querySelector('button').innerText = 'Clear';
+}
+
+/**
+ * @param {String} path
+ * @param {String} name
+ */
+function startDownload(path, name) {
+	const id = addTransfer(name, false, 0);
+	transfers.get(id).chunks = [];
+
+	send('sftp-download', { id, path });
+}
+
+/**
+ * @param {File} file
+ */
+function startUpload(file) {
+	const id = addTransfer(file.name, true, file.size);
+	transfers.get(id).file = file;
+
+	send('sftp-upload', { id, path: joinPath(cwd, file.name), size: file.size });
+}
+
+/**
+ * Sends the next chunk of the upload.
+ * Each chunk is sent once the previous chunk is acknowledged with a progress message.
+ * @param {String} id
+ */
+async function sendNextChunk(id) {
+	const transfer = transfers.get(id);
+
+	if(transfer.bytes >= transfer.size) {
+		send('sftp-done', { id });
+		return;
+	}
+
+	const blob = transfer.file.slice(transfer.bytes, transfer.bytes + chunkSize);
+	const bytes = new Uint8Array(await blob.arrayBuffer());
+
+	send('sftp-chunk', { id, data: bytesToBase64(bytes) });
+}
+
+/**
+ * @param {SftpMsg} data
+ */
+function onChunk(data) {
+	const transfer = transfers.get(data.id);
+	if(!transfer) return;
+
+	const bytes = base64ToBytes(data.data);
+
+	transfer.chunks.push(bytes);
+	transfer.bytes += bytes.length;
+}
+
+/**
+ * @param {SftpMsg} data
+ */
+function onProgress(data) {
+	const transfer = transfers.get(data.id);
+	if(!transfer) return;
+
+	/** @type {HTMLProgressElement} */
+	const progress = transfer.el.querySelector('progress');
+	progress.max = data.size || 1;
+	progress.value = data.bytes ?? 0;
+
+	if(!transfer.upload) return;
+
+	transfer.bytes = data.bytes ?? 0;
+	sendNextChunk(data.id);
+}
+
+/**
+ * @param {SftpMsg} data
+ */
+function onDone(data) {
+	const transfer = transfers.get(data.id);
+	if(!transfer) return;
+
+	if(transfer.upload) {
+		listDir(cwd);
+	} else {
+		const blob = new Blob(transfer.chunks);
+		const url = URL.createObjectURL(blob);
+
+		const anchor = document.createElement('a');
+		anchor.href = url;
+		anchor.download = transfer.name;
+		anchor.click();
+
+		setTimeout(() => URL.revokeObjectURL(url), 1000);
+	}
+
+	finishTransfer(data.id, 'done');
+}
+
+/**
+ * @param {SftpMsg} data
+ */
+function onError(data) {
+	console.log('sftp error', data);
+
+	if(!data.id) return;
+
+	finishTransfer(data.id, data.error);
+}
+
+/**
+ * @param {Uint8Array} bytes
+ */
+function bytesToBase64(bytes) {
+	let binary = '';
+
+	for(let i = 0; i < bytes.length; i += 0x8000) {
+		binary += String.fromCharCode(...bytes.subarray(i, i + 0x8000));
+	}
+
+	return btoa(binary);
+}
+
+/**
+ * @param {String} base64
+ */
+function base64ToBytes(base64) {
+	const binary = atob(base64);
+	const bytes = new Uint8Array(binary.length);
+
+	for(let i = 0; i < binary.length; i++) {
+		bytes[i] = binary.charCodeAt(i);
+	}
+
+	return bytes;
+}
+
+export function initFiles() {
+	pathForm.addEventListener('submit', (ev) => {
+		ev.preventDefault();
+		listDir(pathInput.value);
+	});
+
+	pathForm.querySelector('button[name="up"]').addEventListener('click', () => {
+		listDir(joinPath(cwd, '..'));
+	});
+
+	dropZone.addEventListener('dragover', (ev) => {
+		ev.preventDefault();
+		dropZone.classList.add('dragging');
+	});
+
+	dropZone.addEventListener('dragleave', () => {
+		dropZone.classList.remove('dragging');
+	});
+
+	dropZone.addEventListener('drop', (ev) => {
+		ev.preventDefault();
+		dropZone.classList.remove('dragging');
+
+		Array.from(ev.dataTransfer.files).forEach((file) => startUpload(file));
+	});
+}
@@ -1,19 +1,37 @@
 import ghLogo from './brand-github.svg?raw';
 import icSettings from './settings.svg?raw';
+import icFolder from './folder.svg?raw';
+import icList from './list.svg?raw';
 import icSideClosed from './layout-sidebar-right-collapse.svg?raw';
 import icSideOpened from './layout-sidebar-right-collapse-2.svg?raw';
 import { Terminal } from '@xterm/xterm';
 import { FitAddon } from '@xterm/addon-fit';
 import { WebLinksAddon } from '@xterm/addon-web-links';
+import { connectSftpWs, closeSftpWs, initFiles } from './files.js';
 
 /**
  * @typedef {Object} WsMessage
  * @property {String} type
  * @property {String} data
+ * @property {String} [session] The id of the session the message belongs to.
  */
 
-const term = new Terminal();
-const fitAddon = new FitAddon();
+/**
+ * @typedef {Object} TermSession
+ * @property {String} id
+ * @property {Terminal} term
+ * @property {FitAddon} fitAddon
+ * @property {HTMLDivElement} el The terminal element.
+ * @property {HTMLDivElement} tab
+ * @property {Boolean} isOnNewline
+ * @property {Boolean} opened Whether the session's config was sent to the server.
+ * @property {Boolean} connected
+ * @property {Boolean} closing
+ * @property {String} [token] The token for resuming the session after reconnecting.
+ * @property {String} [shareLink] The link for viewing the session read-only.
+ * @property {Array<Viewer>} viewers The users viewing the shared session.
+ * @property {Array<PortForward>} forwards
+ */
 
 /** @type {HTMLButtonElement} */
 const toggleSettings = document.querySelector('#toggle-opts');
@@ -21,12 +39,30 @@ const toggleSettings = document.querySelector('#toggle-opts');
 /** @type {HTMLButtonElement} */
 const toggleScroll = document.querySelector('#toggle-scroll');
 
+/** @type {HTMLButtonElement} */
+const toggleFiles = document.querySelector('#toggle-files');
+
+/** @type {HTMLElement} */
+const filesView = document.querySelector('#files');
+
+/** @type {HTMLButtonElement} */
+const toggleSessions = document.querySelector('#toggle-sessions');
+
+/** @type {HTMLElement} */
+const sessionsView = document.querySelector('#sessions');
+
 /** @type {HTMLDivElement} */
 const termContainer = document.querySelector('#xterm-container');
 
 /** @type {HTMLElement} */
 const termView = document.querySelector('#term-view');
 
+/** @type {HTMLDivElement} */
+const tabsList = document.querySelector('#tabs .tabs');
+
+/** @type {HTMLButtonElement} */
+const newTab = document.querySelector('#new-tab');
+
 /** @type {HTMLInputElement} */
 const slider = termView.querySelector('input[type="range"]');
 
@@ -42,6 +78,15 @@ const inputFontSize = document.querySelector('#font-size');
 /** @type {HTMLInputElement} */
 const inputFontRange = document.querySelector('#font-range');
 
+/** @type {HTMLFieldSetElement} */
+const forwardsSet = document.querySelector('#forwards');
+
+/** @type {HTMLFieldSetElement} */
+const sharingSet = document.querySelector('#sharing');
+
+/** @type {HTMLFieldSetElement} */
+const nodeSet = document.querySelector('#node');
+
 /** @type {HTMLDialogElement} */
 const dialogConn = document.querySelector('#diag-conn');
 
@@ -51,6 +96,9 @@ const dialogProg = document.querySelector('#diag-prog');
 /** @type {HTMLDialogElement} */
 const dialogHosts = document.querySelector('#diag-host-prompt');
 
+/** @type {HTMLDialogElement} */
+const dialogPrompt = document.querySelector('#diag-auth-prompt');
+
 /** @type {HTMLDialogElement} */
 const dialogErr = document.querySelector('#diag-err');
 
@@ -66,8 +114,39 @@ const machineSelect = settingsForm.querySelector('select[name="machine"]');
 /** @type {HTMLSelectElement} */
 const typeSelect = settingsForm.querySelector('select[name="address-type"]');
 
+/** @type {HTMLDivElement} */
+const machineFilters = settingsForm.querySelector('.filters');
+
+/** @type {HTMLSelectElement} */
+const authSelect = configForm.querySelector('select[name="auth"]');
+
+/** @type {HTMLSelectElement} */
+const keySelect = configForm.querySelector('select[name="key"]');
+
+/** @type {HTMLButtonElement} */
+const cancelConn = configForm.querySelector('button[name="cancel"]');
+
 let scrollVisible = false;
 
+let filesVisible = false;
+
+let sessionsVisible = false;
+
+/** @type {Map<String, TermSession>} */
+const sessions = new Map();
+
+/**
+ * The displayed session.
+ * @type {TermSession}
+ */
+let active;
+
+/**
+ * The session the connection and prompt dialogs act on.
+ * @type {TermSession}
+ */
+let dialogSession;
+
 /** @type {WebSocket} */
 let initWs;
 
@@ -77,17 +156,32 @@ let tsWs;
 /** @type {String} */
 let tsWsUrl;
 
-/** @type {Array} */
+/**
+ * @typedef {Object} PeerInfo
+ * @property {String} id
+ * @property {String} domain
+ * @property {String} shortDomain
+ * @property {Array<String>} ips
+ * @property {Boolean} online
+ * @property {String} [lastSeen] When an offline machine was last connected.
+ * @property {String} os
+ * @property {Array<String>} tags
+ * @property {String} owner The login name of the machine's user. Empty for tagged machines.
+ * @property {Boolean} tailscaleSsh
+ * @property {Boolean?} sshReachable Whether port 22 accepted a connection. Null if unknown.
+ */
+
+/** @type {Array<PeerInfo>} */
 let peerInfos;
 
-const proto = (location.protocol === 'https:') ? 'wss:' : 'ws:';
+/** @type {Number} */
+let connectTid;
 
-/**
- * Tracks the newline status of received server data output to the terminal UI.
- * 
- * Server output will usually contain a newline but returned PTY output might not.
- */
-let isOnNewline = true;
+let reconnectAttempts = 0;
+
+const maxReconnectAttempts = 30;
+
+const proto = (location.protocol === 'https:') ? 'wss:' : 'ws:';
 
 function connectInitWs() {
 	initWs = new WebSocket(`${proto}//${location.host}/ts`);
@@ -95,8 +189,7 @@ function connectInitWs() {
 	const machineMsg = 'Tailscale machine';
 
 	initWs.onopen = (ev) => {
-		term.write('Init WebSocket open.\r\n');
-		isOnNewline = true;
+		writeLine(active, 'Init WebSocket open.');
 	};
 
 	initWs.onmessage = (ev) => {
@@ -115,38 +208,45 @@ function connectInitWs() {
 
 			case 'peers':
 				const infos = JSON.parse(msg.data);
-				peerInfos = infos.sort((a, b) => a.shortDomain.localeCompare(b.shortDomain));
+				peerInfos = infos;
 				
 				updateMachines();
+				return
+
+			case 'ssh-keys':
+				updateKeys(JSON.parse(msg.data));
 				dialogConn.showModal();
 				return
+
+			case 'ssh-error':
+				// The config was rejected so don't connect to the ts websocket
+				clearTimeout(connectTid);
+
+				dialogProg.close();
+				showSshError(msg.data);
+				return
 			
 			default:
 				return
 		}
 
-		term.write(`${msg.data}\r\n`);
-		isOnNewline = true;
+		writeLine(active, msg.data);
 	};
 
 	initWs.onerror = (ev) => {
 		dialogProg.close();
 
 		console.log(ev);
-		term.write('Init WebSocket error.\r\n');
-
-		isOnNewline = true;
+		writeLine(active, 'Init WebSocket error.');
 	}
 
 	initWs.onclose = (ev) => {
 		dialogProg.close();
-		dialogConn.close();
 
-		console.log(ev);
-		const msg = `Init WebSocket closed. ${ev.reason || ''}\r\n`;
-		term.write((isOnNewline) ? msg : `\r\n${msg}`);
+		if(!tsWs) dialogConn.close();
 
-		isOnNewline = true;
+		console.log(ev);
+		writeLine(active, `Init WebSocket closed. ${ev.reason || ''}`);
 	};
 
 	window.addEventListener('pagehide', () => {
@@ -157,16 +257,6 @@ function connectInitWs() {
 function connectTsWs(url) {
 	tsWs = new WebSocket(url);
 
-	term.onData((data) => {
-		/** @type {WsMessage} */
-		const msg = {
-			type: 'input',
-			data
-		};
-
-		tsWs.send(JSON.stringify(msg));
-	});
-
 	tsWs.onopen = (ev) => {
 		dialogProg.close();
 
@@ -175,40 +265,132 @@ function connectTsWs(url) {
 			type: 'ts-websocket-opened',
 		};
 
-		initWs.send(JSON.stringify(msg));
-		term.write('Tailscale WebSocket open.\r\n');
+		if(initWs.readyState === WebSocket.OPEN) initWs.send(JSON.stringify(msg));
+		writeLine(active, 'Tailscale WebSocket open.');
+
+		newTab.disabled = false;
+		cancelConn.style.display = '';
+
+		// Resume the sessions which were running before reconnecting
+		if(reconnectAttempts > 0) {
+			sessions.forEach((session) => {
+				if(session.token) sendSessionMsg(session, 'session-resume', session.token);
+			});
+		}
 
-		isOnNewline = true;
+		reconnectAttempts = 0;
 	};
 
 	tsWs.onmessage = (ev) => {
 		console.log(ev);
 
-		dialogProg.close();
-
 		/** @type {WsMessage} */
 		const msg = JSON.parse(ev.data);
 
+		// Messages without a session are displayed in the active session
+		const session = (msg.session) ? sessions.get(msg.session) : active;
+		if(!session) return;
+
 		switch(msg.type) {
 			case 'ssh-error':
-				dialogErr.showModal();
+				dialogProg.close();
+				dialogSession = session;
+
+				showSshError(msg.data);
 				return;
 			case 'ssh-host':
+				dialogProg.close();
+				dialogSession = session;
+
 				const host = dialogHosts.querySelector('#host');
 				host.innerHTML = msg.data;
 
 				dialogHosts.showModal();
 				return;
+			case 'ssh-prompt':
+				dialogProg.close();
+				dialogSession = session;
+
+				showAuthPrompt(JSON.parse(msg.data));
+				return;
 			case 'ssh-success':
-				onSize();
+				dialogProg.close();
+
+				session.connected = true;
+				if(msg.data) setTabLabel(session, msg.data);
+
+				onSize(session);
+
+				if(session === active && filesVisible) connectSftpWs(tsWsUrl, session.id);
+				return;
+			case 'session-token':
+				session.token = msg.data;
+				return;
+			case 'session-resume':
+				session.term.reset();
+				session.term.write(msg.data);
+				session.isOnNewline = msg.data.endsWith('\r\n');
+				session.opened = true;
+				session.connected = true;
+				session.tab.classList.remove('closed');
+
+				onSize(session);
+
+				if(session === active && filesVisible) connectSftpWs(tsWsUrl, session.id);
+				return;
+			case 'session-closed':
+				onSessionClosed(session, msg.data);
+				return;
+			case 'session-share':
+				const { node, token } = JSON.parse(msg.data);
+
+				const params = new URLSearchParams({ view: session.id, node, token });
+				session.shareLink = `${location.origin}${location.pathname}?${params}`;
+
+				if(session === active) updateSharing(session);
+				return;
+			case 'session-viewers':
+				session.viewers = JSON.parse(msg.data);
+				if(session === active) updateSharing(session);
+				return;
+			case 'forwards':
+				session.forwards = JSON.parse(msg.data);
+				if(session === active) updateForwards(session.forwards);
 				return;
 			case 'info':
-				term.write(msg.data + '\r\n');
-				isOnNewline = true;
+				writeLine(session, msg.data);
 				break;
+			case 'node-info':
+				const { name, persistent } = JSON.parse(msg.data);
+
+				nodeSet.querySelector('.name').innerText = (persistent) ? `${name} (yours)` : name;
+				nodeSet.querySelector('button[name="forget"]').style.display = (persistent) ? '' : 'none';
+				return;
+			case 'peers':
+				peerInfos = JSON.parse(msg.data);
+				updateMachines();
+				return;
+			case 'peer-add':
+			case 'peer-update':
+				/** @type {PeerInfo} */
+				const peer = JSON.parse(msg.data);
+				const idx = peerInfos?.findIndex((info) => info.id === peer.id) ?? -1;
+
+				if(idx < 0) {
+					peerInfos = [...(peerInfos ?? []), peer];
+				} else {
+					peerInfos[idx] = peer;
+				}
+
+				updateMachines();
+				return;
+			case 'peer-remove':
+				peerInfos = peerInfos?.filter((info) => info.id !== msg.data);
+				updateMachines();
+				return;
 			case 'output':
-				term.write(msg.data);
-				isOnNewline = msg.data.endsWith('\r\n');
+				session.term.write(msg.data);
+				session.isOnNewline = msg.data.endsWith('\r\n');
 				break;
 		}
 	};
@@ -223,24 +405,31 @@ function connectTsWs(url) {
 			type: 'ts-websocket-error',
 		};
 
-		initWs.send(JSON.stringify(wsMsg));
-
-		const msg = 'Tailscale WebSocket error.\r\n';
-		term.write((isOnNewline) ? msg : `\r\n${msg}`);
+		if(initWs.readyState === WebSocket.OPEN) initWs.send(JSON.stringify(wsMsg));
 
-		isOnNewline = true;
+		writeLine(active, 'Tailscale WebSocket error.');
 	}
 
 	tsWs.onclose = (ev) => {
 		console.log(ev);
 
 		dialogProg.close();
+		dialogConn.close();
 		dialogErr.close();
 
-		const msg = `Tailscale WebSocket closed. ${ev.reason || ''}\r\n`;
-		term.write((isOnNewline) ? msg : `\r\n${msg}`);
+		newTab.disabled = true;
+		cancelConn.style.display = 'none';
+
+		sessions.forEach((session) => session.connected = false);
+		closeSftpWs();
+
+		writeLine(active, `Tailscale WebSocket closed. ${ev.reason || ''}`);
+
+		// Running sessions are kept alive on the node for a while
+		// so reconnect and resume them.
+		const resumable = Array.from(sessions.values()).some((session) => session.token);
 
-		isOnNewline = true;
+		if(resumable) reconnectTsWs();
 	};
 
 	window.addEventListener('pagehide', () => {
@@ -248,30 +437,746 @@ function connectTsWs(url) {
 	});
 }
 
-function onSize() {
-	const { rows, cols } = term;
-	const { clientWidth, clientHeight } = termScreen;
-	console.log(`rows: ${rows}, cols: ${cols}, width: ${clientWidth}, height: ${clientHeight}`);
+/**
+ * Reconnects to the Tailscale WebSocket after an increasing delay.
+ */
+function reconnectTsWs() {
+	if(reconnectAttempts >= maxReconnectAttempts) {
+		writeLine(active, 'Unable to reconnect.');
+		return;
+	}
 
-	if(!tsWs) return;
+	const delay = Math.min(1000 * 2 ** reconnectAttempts, 10000);
+	reconnectAttempts++;
 
+	writeLine(active, `Reconnecting in ${delay / 1000}s...`);
+
+	setTimeout(() => connectTsWs(tsWsUrl), delay);
+}
+
+/**
+ * Sends the message for the session on the Tailscale WebSocket.
+ * @param {TermSession} session
+ * @param {String} type
+ * @param {String} [data]
+ */
+function sendSessionMsg(session, type, data) {
+	if(tsWs?.readyState !== WebSocket.OPEN) return;
+
+	/** @type {WsMessage} */
 	const msg = {
-		type: 'size',
-		data: JSON.stringify({ rows, cols, x: clientWidth, y: clientHeight }),
+		type,
+		data,
+		session: session.id,
 	};
 
 	tsWs.send(JSON.stringify(msg));
 }
 
+/**
+ * Writes the message on its own line of the session's terminal.
+ * @param {TermSession} session
+ * @param {String} msg
+ */
+function writeLine(session, msg) {
+	session.term.write((session.isOnNewline) ? `${msg}\r\n` : `\r\n${msg}\r\n`);
+
+	// Server output will usually contain a newline but returned PTY output might not
+	session.isOnNewline = true;
+}
+
+/**
+ * @param {TermSession} session
+ */
+function onSize(session) {
+	const { rows, cols } = session.term;
+	const { clientWidth, clientHeight } = session.el.querySelector('.xterm-screen');
+	console.log(`rows: ${rows}, cols: ${cols}, width: ${clientWidth}, height: ${clientHeight}`);
+
+	if(!session.connected) return;
+
+	sendSessionMsg(session, 'size', JSON.stringify({ rows, cols, x: clientWidth, y: clientHeight }));
+}
+
+/**
+ * Creates a session's terminal and tab.
+ * @param {String} [id]
+ * @returns {TermSession}
+ */
+function createSession(id = crypto.randomUUID()) {
+	const term = new Terminal();
+	const fitAddon = new FitAddon();
+
+	if(inputFontSize.value) term.options.fontSize = Number(inputFontSize.value);
+
+	const el = document.createElement('div');
+	el.className = 'term';
+	termContainer.append(el);
+
+	term.loadAddon(fitAddon);
+	term.loadAddon(new WebLinksAddon());
+	term.open(el);
+
+	const tab = document.createElement('div');
+	tab.className = 'tab';
+
+	const label = document.createElement('button');
+	label.className = 'label';
+	label.innerText = 'New session';
+
+	const detach = document.createElement('button');
+	detach.className = 'detach';
+	detach.innerText = '⏏';
+	detach.title = 'Detach session';
+
+	const close = document.createElement('button');
+	close.className = 'close';
+	close.innerText = '×';
+	close.title = 'Close session';
+
+	tab.append(label, detach, close);
+	tabsList.append(tab);
+
+	/** @type {TermSession} */
+	const session = {
+		id,
+		term,
+		fitAddon,
+		el,
+		tab,
+		isOnNewline: true,
+		opened: false,
+		connected: false,
+		closing: false,
+		forwards: [],
+		viewers: [],
+	};
+
+	label.addEventListener('click', () => showSession(session));
+	detach.addEventListener('click', () => detachSession(session));
+	close.addEventListener('click', () => closeSession(session));
+
+	term.onData((data) => {
+		if(!session.connected) return;
+
+		sendSessionMsg(session, 'input', data);
+	});
+
+	/** @type {Number} */
+	let tid;
+
+	term.onResize(({ rows, cols }) => {
+		clearTimeout(tid);
+		tid = setTimeout(() => onSize(session), 500);
+	});
+
+	term.onLineFeed(() => {
+		if(session === active) updateSlider();
+	});
+
+	term.onScroll((n) => {
+		if(session !== active || isDragging) return;
+
+		const pos = n / (term.buffer.active.length - term.rows) * term.buffer.active.length;
+		slider.value = pos;
+	});
+
+	sessions.set(id, session);
+
+	return session;
+}
+
+/**
+ * Displays the session's terminal.
+ * @param {TermSession} session
+ */
+function showSession(session) {
+	active = session;
+
+	sessions.forEach((s) => {
+		s.el.style.display = (s === session) ? '' : 'none';
+		s.tab.classList.toggle('active', s === session);
+	});
+
+	session.fitAddon.fit();
+	session.term.focus();
+
+	updateSlider();
+	updateForwards(session.forwards);
+	updateSharing(session);
+
+	if(!filesVisible) return;
+
+	if(session.connected) {
+		connectSftpWs(tsWsUrl, session.id);
+	} else {
+		closeSftpWs();
+	}
+}
+
+/**
+ * @param {TermSession} session
+ * @param {String} label
+ */
+function setTabLabel(session, label) {
+	session.tab.querySelector('.label').innerText = label;
+	session.tab.title = label;
+}
+
+/**
+ * Ends the session if it's running on the server
+ * or removes it otherwise.
+ * @param {TermSession} session
+ */
+function closeSession(session) {
+	if(session.opened && tsWs?.readyState === WebSocket.OPEN) {
+		session.closing = true;
+		sendSessionMsg(session, 'session-close');
+		return;
+	}
+
+	removeSession(session);
+}
+
+/**
+ * Leaves the session running on the server without this browser attached.
+ * It can be reattached from the session list.
+ * @param {TermSession} session
+ */
+function detachSession(session) {
+	if(!session.connected) return;
+
+	sendSessionMsg(session, 'session-detach');
+
+	session.opened = false;
+	session.connected = false;
+	session.token = undefined;
+	session.shareLink = undefined;
+	session.viewers = [];
+	session.tab.classList.add('closed');
+
+	if(session === active) {
+		closeSftpWs();
+		updateSharing(session);
+	}
+
+	writeLine(session, 'Session detached.');
+	removeSession(session);
+
+	if(sessionsVisible) updateSessionList();
+}
+
+/**
+ * Attaches the running session to this browser.
+ * @param {SessionInfo} info
+ */
+function attachSession(info) {
+	const existing = sessions.get(info.id);
+
+	if(existing?.connected) {
+		showSession(existing);
+		return;
+	}
+
+	const session = existing ?? createSession(info.id);
+	setTabLabel(session, `${info.user}@${info.host}`);
+	showSession(session);
+
+	sendSessionMsg(session, 'session-attach');
+}
+
+/**
+ * @typedef {Object} SessionInfo
+ * @property {String} id
+ * @property {String} host
+ * @property {String} user
+ * @property {String} node
+ * @property {String} started
+ * @property {Number} idle Seconds since the last input or output.
+ * @property {Boolean} attached
+ */
+
+/**
+ * Lists the user's running sessions on every node.
+ */
+async function updateSessionList() {
+	const list = sessionsView.querySelector('ul');
+
+	if(tsWs?.readyState !== WebSocket.OPEN) {
+		list.innerHTML = '<li>Connect to list the running sessions.</li>';
+		return;
+	}
+
+	/** @type {Array<SessionInfo>} */
+	let infos;
+
+	try {
+		const resp = await fetch(`${tsWsUrl.replace(/^ws/, 'http')}/sessions`);
+		if(!resp.ok) throw new Error(await resp.text());
+
+		infos = await resp.json();
+	} catch(err) {
+		console.log(err);
+		list.innerHTML = '<li>Unable to list the running sessions.</li>';
+		return;
+	}
+
+	list.replaceChildren();
+
+	if(infos.length === 0) list.innerHTML = '<li>No running sessions.</li>';
+
+	infos.forEach((info) => {
+		const item = document.createElement('li');
+
+		const host = document.createElement('span');
+		host.className = 'host';
+		host.innerText = `${info.user}@${info.host}`;
+
+		const details = document.createElement('span');
+		details.className = 'details';
+		details.innerText = `started ${new Date(info.started).toLocaleString()}, idle ${formatDuration(info.idle)}`;
+		details.title = info.node;
+
+		const here = sessions.get(info.id)?.connected;
+
+		const attach = document.createElement('button');
+		attach.innerText = (here) ? 'Show' : 'Attach';
+		attach.title = (info.attached && !here) ? 'Attached in another browser' : '';
+		attach.addEventListener('click', () => attachSession(info));
+
+		item.append(host, details, attach);
+		list.append(item);
+	});
+}
+
+/**
+ * @param {Number} secs
+ * @returns {String} The duration in the largest whole unit. ex. '5m'
+ */
+function formatDuration(secs) {
+	if(secs < 60) return `${secs}s`;
+	if(secs < 3600) return `${Math.floor(secs / 60)}m`;
+	if(secs < 86400) return `${Math.floor(secs / 3600)}h`;
+
+	return `${Math.floor(secs / 86400)}d`;
+}
+
+/**
+ * @param {TermSession} session
+ * @param {String} [reason]
+ */
+function onSessionClosed(session, reason) {
+	session.opened = false;
+	session.connected = false;
+	session.token = undefined;
+	session.shareLink = undefined;
+	session.viewers = [];
+	session.tab.classList.add('closed');
+
+	if(session === active) updateSharing(session);
+
+	if(session === dialogSession) {
+		dialogProg.close();
+		dialogHosts.close();
+		dialogPrompt.close();
+		dialogErr.close();
+	}
+
+	if(session === active) closeSftpWs();
+
+	if(session.closing) {
+		removeSession(session);
+		return;
+	}
+
+	writeLine(session, `Session closed. ${reason || ''}`);
+}
+
+/**
+ * Removes the session's terminal and tab.
+ * The last session is kept to display the connection status.
+ * @param {TermSession} session
+ */
+function removeSession(session) {
+	if(sessions.size <= 1) return;
+
+	sessions.delete(session.id);
+
+	session.term.dispose();
+	session.el.remove();
+	session.tab.remove();
+
+	if(session === active) showSession(Array.from(sessions.values()).at(-1));
+}
+
+function updateSlider() {
+	const { term } = active;
+
+	const thumbHeight = Math.round(term.rows / term.buffer.active.length * 100);
+
+	termView.style.setProperty('--slider-thumb-height', `clamp(2rem, ${thumbHeight}%, 100%)`);
+	slider.max = term.buffer.active.length;
+}
+
+/**
+ * @typedef {Object} PortForward
+ * @property {String} id
+ * @property {String} type
+ * @property {Number} port
+ * @property {String} address
+ * @property {String} target
+ */
+
+/**
+ * @param {Array<PortForward>} forwards
+ */
+function updateForwards(forwards) {
+	const list = forwardsSet.querySelector('ul');
+	list.replaceChildren();
+
+	forwards.forEach((fwd) => {
+		const item = document.createElement('li');
+
+		const from = (fwd.type === 'remote') ? `host ${fwd.address}` : fwd.address;
+
+		const desc = document.createElement('span');
+		desc.innerText = `${from} \u2192 ${fwd.target}`;
+
+		const remove = document.createElement('button');
+		remove.innerText = 'Remove';
+		remove.addEventListener('click', () => {
+			sendSessionMsg(active, 'forward-remove', fwd.id);
+		});
+
+		item.append(desc, remove);
+		list.append(item);
+	});
+}
+
+/**
+ * @typedef {Object} Viewer
+ * @property {String} id
+ * @property {String} name The viewer's Tailscale user.
+ * @property {String} node The viewer's Tailscale machine.
+ * @property {Boolean} control Whether the viewer can type into the session.
+ */
+
+/**
+ * @param {TermSession} session
+ */
+function updateSharing(session) {
+	/** @type {HTMLInputElement} */
+	const link = sharingSet.querySelector('input[name="link"]');
+	link.value = session.shareLink ?? '';
+
+	sharingSet.querySelector('button[name="copy"]').disabled = !session.shareLink;
+	sharingSet.querySelector('button[name="unshare"]').disabled = !session.shareLink;
+
+	const list = sharingSet.querySelector('.viewers');
+	list.replaceChildren();
+
+	session.viewers.forEach((viewer) => {
+		const item = document.createElement('li');
+
+		const desc = document.createElement('span');
+		desc.innerText = `${viewer.name} (${viewer.node})`;
+
+		const control = document.createElement('button');
+		control.innerText = (viewer.control) ? 'Take control' : 'Give control';
+		control.addEventListener('click', () => {
+			sendSessionMsg(session, 'session-control', JSON.stringify({ viewer: viewer.id, control: !viewer.control }));
+		});
+
+		item.append(desc, control);
+		list.append(item);
+	});
+}
+
+/**
+ * Displays the session shared in the page's params
+ * instead of connecting to a host.
+ * Input is only sent while the owner grants control.
+ * @param {URLSearchParams} params
+ */
+function connectViewWs(params) {
+	const shareParams = new URLSearchParams({ session: params.get('view'), token: params.get('token') });
+
+	const viewWs = new WebSocket(`${proto}//${params.get('node')}/share?${shareParams}`);
+
+	let control = false;
+
+	setTabLabel(active, 'Shared session');
+
+	/**
+	 * @param {String} type
+	 * @param {String} data
+	 */
+	const sendViewMsg = (type, data) => {
+		if(viewWs.readyState !== WebSocket.OPEN) return;
+
+		/** @type {WsMessage} */
+		const msg = {
+			type,
+			data,
+			session: params.get('view'),
+		};
+
+		viewWs.send(JSON.stringify(msg));
+	};
+
+	// The session is sized to fit its smallest client
+	const sendSize = () => {
+		const { rows, cols } = active.term;
+		sendViewMsg('size', JSON.stringify({ rows, cols }));
+	};
+
+	/** @type {Number} */
+	let tid;
+
+	active.term.onResize(() => {
+		clearTimeout(tid);
+		tid = setTimeout(sendSize, 500);
+	});
+
+	active.term.onData((data) => {
+		if(control) sendViewMsg('input', data);
+	});
+
+	viewWs.onopen = (ev) => {
+		writeLine(active, 'Viewing the shared session. Input is disabled.');
+		sendSize();
+	};
+
+	viewWs.onmessage = (ev) => {
+		/** @type {WsMessage} */
+		const msg = JSON.parse(ev.data);
+
+		switch(msg.type) {
+			case 'session-resume':
+				active.term.reset();
+				active.term.write(msg.data);
+				active.isOnNewline = msg.data.endsWith('\r\n');
+				break;
+			case 'output':
+				active.term.write(msg.data);
+				active.isOnNewline = msg.data.endsWith('\r\n');
+				break;
+			case 'session-control':
+				control = JSON.parse(msg.data).control;
+				setTabLabel(active, (control) ? 'Shared session (control)' : 'Shared session');
+				break;
+			case 'info':
+				writeLine(active, msg.data);
+				break;
+		}
+	};
+
+	viewWs.onerror = (ev) => {
+		console.log(ev);
+		writeLine(active, 'Shared session WebSocket error.');
+	};
+
+	viewWs.onclose = (ev) => {
+		console.log(ev);
+
+		active.tab.classList.add('closed');
+		writeLine(active, `Stopped viewing the shared session. ${ev.reason || ''}`);
+	};
+
+	window.addEventListener('pagehide', () => {
+		viewWs.close();
+	});
+}
+
+/**
+ * Lists the machines matching the filters in the selected order.
+ * Options keep the machine's ID so the selection survives list updates.
+ */
 function updateMachines() {
-	let machineOpts = `<option value="">-- machines --</option>\n`;
+	if(!peerInfos) return;
 
-	peerInfos.forEach((info, i) => {
-		const { shortDomain, ips } = info;
-		machineOpts += `<option value="${i}">${shortDomain} [${ips[0]}]</option>\n`;
+	const formData = new FormData(settingsForm);
+
+	const filter = (formData.get('filter') ?? '').toString().trim().toLowerCase();
+	const onlineOnly = formData.has('online-only');
+	const sshOnly = formData.has('ssh-only');
+
+	const matches = peerInfos
+		.filter((info) => {
+			if(onlineOnly && !info.online) return false;
+			if(sshOnly && !info.tailscaleSsh && !info.sshReachable) return false;
+			if(!filter) return true;
+
+			const fields = [info.domain, info.os, info.owner, ...info.ips, ...info.tags];
+			return fields.some((field) => field?.toLowerCase().includes(filter));
+		})
+		.sort((a, b) => compareMachines(a, b, formData.get('sort')));
+
+	const selected = machineSelect.value;
+
+	let machineOpts = `<option value="">-- machines (${matches.length}/${peerInfos.length}) --</option>\n`;
+
+	matches.forEach((info) => {
+		machineOpts += `<option value="${info.id}">${describeMachine(info)}</option>\n`;
 	});
 
 	machineSelect.innerHTML = machineOpts;
+	machineSelect.value = selected;
+}
+
+/**
+ * @param {PeerInfo} a
+ * @param {PeerInfo} b
+ * @param {String} sort
+ * @returns {Number}
+ */
+function compareMachines(a, b, sort) {
+	const byName = a.shortDomain.localeCompare(b.shortDomain);
+
+	switch(sort) {
+		case 'online':
+			return (Number(b.online) - Number(a.online)) || byName;
+		case 'last-seen':
+			// Online machines are seen now
+			const seen = (info) => (info.online) ? Infinity : Date.parse(info.lastSeen ?? 0) || 0;
+			return (seen(b) - seen(a)) || byName;
+		case 'os':
+			return a.os.localeCompare(b.os) || byName;
+		case 'owner':
+			return (a.owner || a.tags.join(',')).localeCompare(b.owner || b.tags.join(',')) || byName;
+	}
+
+	return byName;
+}
+
+/**
+ * @param {PeerInfo} info
+ * @returns {String} ex. '● devbox [100.64.0.1] linux, alice@example.com, ssh'
+ */
+function describeMachine(info) {
+	const details = [info.os, info.owner || info.tags.join(' ')];
+
+	if(info.tailscaleSsh) {
+		details.push('Tailscale SSH');
+	} else if(info.sshReachable) {
+		details.push('ssh');
+	} else if(info.sshReachable === false) {
+		details.push('no ssh');
+	}
+
+	if(!info.online && info.lastSeen) details.push(`seen ${new Date(info.lastSeen).toLocaleDateString()}`);
+
+	const status = (info.online) ? '●' : '○';
+	const description = `${status} ${info.shortDomain} [${info.ips[0]}] ${details.filter(Boolean).join(', ')}`;
+
+	return escapeHtml(description);
+}
+
+/**
+ * @param {String} text
+ * @returns {String}
+ */
+function escapeHtml(text) {
+	const span = document.createElement('span');
+	span.textContent = text;
+
+	return span.innerHTML;
+}
+
+/**
+ * @param {Array<String>} keys
+ */
+function updateKeys(keys) {
+	let keyOpts = `<option value="">-- keys --</option>\n`;
+
+	keys.forEach((key) => {
+		keyOpts += `<option value="${key}">${key}</option>\n`;
+	});
+
+	keySelect.innerHTML = keyOpts;
+}
+
+function onAuthSelect() {
+	const auth = authSelect.value;
+
+	configForm.querySelectorAll('.auth-key').forEach((el) => {
+		el.style.display = (auth === 'key') ? '' : 'none';
+	});
+
+	configForm.querySelectorAll('.auth-upload').forEach((el) => {
+		el.style.display = (auth === 'upload') ? '' : 'none';
+	});
+
+	keySelect.required = (auth === 'key');
+
+	/** @type {HTMLInputElement} */
+	const password = configForm.querySelector('input[name="password"]');
+	password.required = (auth === 'password');
+	password.placeholder = (auth === 'password') ? 'password' : 'passphrase (optional)';
+
+	configForm.querySelector('#password-label').innerText = (auth === 'password') ? 'Password' : 'Passphrase';
+}
+
+/**
+ * Reads the config form's uploaded file or pasted text.
+ * @param {FormData} formData
+ * @param {String} name The name prefix of the form fields. ex. 'key'
+ * @returns {Promise<String>} The file contents or an empty string.
+ */
+async function readUploadedKey(formData, name) {
+	/** @type {File} */
+	const file = formData.get(`${name}-file`);
+
+	const key = (file && file.size > 0) ? await file.text() : formData.get(`${name}-text`);
+
+	if(!key.trim()) return '';
+
+	return key.trim() + '\n';
+}
+
+/**
+ * Parses a ProxyJump style list of jump hosts. ex. 'user@bastion:22, other'
+ * @param {String} jump
+ * @param {String} defaultUser
+ * @param {SshAuth} auth
+ * @returns {Array<SshHost>}
+ */
+function parseJumpHosts(jump, defaultUser, auth) {
+	return jump.split(',')
+		.map((hop) => hop.trim())
+		.filter((hop) => hop !== '')
+		.map((hop) => {
+			let user = defaultUser;
+			let port = 22;
+
+			const atIdx = hop.lastIndexOf('@');
+
+			if(atIdx >= 0) {
+				user = hop.slice(0, atIdx);
+				hop = hop.slice(atIdx + 1);
+			}
+
+			// Match 'host:port' or '[ipv6]:port'
+			const match = hop.match(/^\[?([^\]]+?)\]?(?::(\d+))?$/);
+
+			let address = hop;
+
+			if(match && (hop.startsWith('[') || hop.split(':').length <= 2)) {
+				address = match[1];
+				port = Number(match[2] ?? 22);
+			}
+
+			return { user, auth, address, port };
+		});
+}
+
+/**
+ * Displays the connection error dialog.
+ * @param {String} [details]
+ */
+function showSshError(details) {
+	dialogErr.querySelector('.details').innerText = details || '';
+	dialogErr.showModal();
 }
 
 /**
@@ -280,12 +1185,13 @@ function updateMachines() {
 function onMachineSelect(event) {
 	const formData = new FormData(settingsForm);
 
-	const machineIdx = formData.get('machine');
+	const machineId = formData.get('machine');
 	const type = formData.get('address-type');
 
-	if(machineIdx === '') return;
+	if(!machineId) return;
 
-	const info = peerInfos[Number(machineIdx)];
+	const info = peerInfos?.find((info) => info.id === machineId);
+	if(!info) return;
 
 	let address = info.shortDomain;
 
@@ -306,6 +1212,72 @@ function onMachineSelect(event) {
 	configForm.querySelector('input[name="address"]').value = address;
 }
 
+/**
+ * @typedef {Object} SshAuth
+ * @property {String} method 'password', 'key', or 'upload'
+ * @property {String} [password]
+ * @property {String} [key] The server key name or the uploaded private key
+ * @property {String} [passphrase]
+ * @property {String} [certificate]
+ */
+
+/**
+ * @typedef {Object} SshHost
+ * @property {String} user
+ * @property {SshAuth} auth
+ * @property {String} address
+ * @property {Number} port
+ */
+
+/**
+ * @typedef {Object} SshConfig
+ * @property {Number} version
+ * @property {String} user
+ * @property {SshAuth} auth
+ * @property {String} address
+ * @property {Number} port
+ * @property {{forwardAgent: Boolean}} options
+ * @property {Array<SshHost>} [jumpHosts]
+ */
+
+/**
+ * @typedef {Object} SshPrompt
+ * @property {String} host
+ * @property {String} name
+ * @property {String} instruction
+ * @property {Array<{question: String, echo: Boolean}>} questions
+ */
+
+/**
+ * Displays the server's keyboard-interactive questions.
+ * @param {SshPrompt} prompt
+ */
+function showAuthPrompt(prompt) {
+	const name = prompt.name || 'Authentication';
+
+	dialogPrompt.querySelector('#prompt-name').innerText = (prompt.host) ? `${name} (${prompt.host})` : name;
+	dialogPrompt.querySelector('#prompt-instruction').innerText = prompt.instruction;
+
+	const fieldset = dialogPrompt.querySelector('.questions');
+	fieldset.replaceChildren();
+
+	prompt.questions.forEach(({ question, echo }, i) => {
+		const label = document.createElement('label');
+		label.innerText = question.trim();
+
+		const input = document.createElement('input');
+		input.type = (echo) ? 'text' : 'password';
+		input.name = `answer-${i}`;
+		input.autocomplete = 'one-time-code';
+		input.autofocus = (i === 0);
+
+		label.append(input);
+		fieldset.append(label);
+	});
+
+	dialogPrompt.showModal();
+}
+
 /**
  * @param {Element} container 
  * @param {KeyboardEvent} event 
@@ -338,51 +1310,117 @@ function initDialogs() {
 	});
 
 	machineSelect.addEventListener('input', onMachineSelect);
+	machineFilters.addEventListener('input', updateMachines);
+	settingsForm.addEventListener('submit', (ev) => ev.preventDefault());
 	typeSelect.addEventListener('input', onMachineSelect);
+	authSelect.addEventListener('input', onAuthSelect);
+
+	onAuthSelect();
 
 	configForm.addEventListener('submit', async (ev) => {
+		const session = dialogSession;
+
+		if(ev.submitter?.name === 'cancel') {
+			// End the session's pending connection attempt
+			if(session.opened) {
+				sendSessionMsg(session, 'ts-websocket-error');
+				return;
+			}
+
+			removeSession(session);
+			return;
+		}
+
 		dialogProg.showModal();
 
 		const formData = new FormData(ev.target);
 
-		const address = formData.get('address');
-		const port = formData.get('port');
-		const username = formData.get('username');
-		const password = formData.get('password');
+		const auth = formData.get('auth');
 
-		const sshMsg = `${username}:${password}:${address}:${port}`;
+		/** @type {SshAuth} */
+		const sshAuth = { method: auth };
+
+		switch(auth) {
+			case 'password':
+				sshAuth.password = formData.get('password');
+				break;
+
+			case 'key':
+				sshAuth.key = formData.get('key');
+				sshAuth.passphrase = formData.get('password');
+				break;
+
+			case 'upload':
+				sshAuth.key = await readUploadedKey(formData, 'key');
+				sshAuth.certificate = await readUploadedKey(formData, 'cert');
+				sshAuth.passphrase = formData.get('password');
+				break;
+		}
+
+		const user = formData.get('username');
+		const jumpAuth = (formData.get('jump-auth') === 'prompt') ? { method: 'prompt' } : sshAuth;
+
+		/** @type {SshConfig} */
+		const sshCfg = {
+			version: 1,
+			user,
+			auth: sshAuth,
+			address: formData.get('address'),
+			port: Number(formData.get('port')),
+			options: {
+				forwardAgent: formData.get('agent') === 'on',
+			},
+			jumpHosts: parseJumpHosts(formData.get('jump'), user, jumpAuth),
+		};
+
+		setTabLabel(session, `${user}@${sshCfg.address}`);
 
 		/** @type {WsMessage} */
 		const msg = {
 			type: 'ssh-config',
-			data: sshMsg,
+			data: JSON.stringify(sshCfg),
+			session: session.id,
 		};
 
-		const msgStr = JSON.stringify(msg);
-
 		if(!tsWs) {
-			initWs.send(msgStr);
+			session.opened = true;
+			initWs.send(JSON.stringify(msg));
 			
 			// Attempt connection to the ts websocket after a delay
-			setTimeout(() => connectTsWs(tsWsUrl), 1000);
+			connectTid = setTimeout(() => connectTsWs(tsWsUrl), 1000);
 			return;
 		}
 
-		tsWs.send(msgStr);
+		// Additional sessions are opened over the running Tailscale node
+		if(!session.opened) {
+			session.opened = true;
+			session.tab.classList.remove('closed');
+
+			msg.type = 'session-open';
+		}
+
+		tsWs.send(JSON.stringify(msg));
 	});
 
 	dialogHosts.querySelector('form').addEventListener('submit', (ev) => {
 		dialogProg.showModal();
 
 		let action = (ev.submitter.name === 'cancel') ? 'no' : 'yes';
-		
-		/** @type {WsMessage} */
-		const wsMsg = {
-			type: 'ssh-host-action',
-			data: action,
-		};
 
-		tsWs.send(JSON.stringify(wsMsg));
+		sendSessionMsg(dialogSession, 'ssh-host-action', action);
+	});
+
+	dialogPrompt.querySelector('form').addEventListener('submit', (ev) => {
+		dialogProg.showModal();
+
+		let answers = '';
+
+		if(ev.submitter.name !== 'cancel') {
+			const inputs = Array.from(ev.target.querySelectorAll('.questions input'));
+			answers = JSON.stringify(inputs.map((input) => input.value));
+		}
+
+		sendSessionMsg(dialogSession, 'ssh-prompt-action', answers);
 	});
 
 	dialogErr.querySelector('form').addEventListener('submit', (ev) => {
@@ -390,17 +1428,26 @@ function initDialogs() {
 			/** @type {WsMessage} */
 			const wsMsg = {
 				type: 'ts-websocket-error',
+				session: dialogSession.id,
 			};
 
 			(tsWs ?? initWs)?.send(JSON.stringify(wsMsg));
-			
-			const msg = 'Tailscale WebSocket error.\r\n';
-			term.write((isOnNewline) ? msg : `\r\n${msg}`);
+
+			if(!tsWs) writeLine(dialogSession, 'Tailscale WebSocket error.');
 			return;
 		}
 		
 		dialogConn.showModal();
 	});
+
+	newTab.addEventListener('click', () => {
+		if(tsWs?.readyState !== WebSocket.OPEN) return;
+
+		dialogSession = createSession();
+		showSession(dialogSession);
+
+		dialogConn.showModal();
+	});
 }
 
 function initMenu() {
@@ -409,6 +1456,28 @@ function initMenu() {
 	toggleSettings.innerHTML = icSettings;
 	options.style.display = (optsVisible) ? '' : 'none';
 
+	toggleFiles.innerHTML = icFolder;
+	filesView.style.display = (filesVisible) ? '' : 'none';
+
+	toggleSessions.innerHTML = icList;
+	sessionsView.style.display = (sessionsVisible) ? '' : 'none';
+
+	toggleSessions.addEventListener('click', () => {
+		sessionsVisible = !sessionsVisible;
+		sessionsView.style.display = (sessionsVisible) ? '' : 'none';
+
+		if(sessionsVisible) updateSessionList();
+	});
+
+	sessionsView.querySelector('button[name="refresh"]').addEventListener('click', updateSessionList);
+
+	toggleFiles.addEventListener('click', () => {
+		filesVisible = !filesVisible;
+		filesView.style.display = (filesVisible) ? '' : 'none';
+
+		if(filesVisible && active.connected) connectSftpWs(tsWsUrl, active.id);
+	});
+
 	updateToggleScroll();
 
 	toggleSettings.addEventListener('click', () => {
@@ -423,7 +1492,54 @@ function initMenu() {
 }
 
 function initOptions() {
-	const { fontSize } = term.options;
+	const { fontSize } = active.term.options;
+
+	forwardsSet.querySelector('form').addEventListener('submit', (ev) => {
+		ev.preventDefault();
+
+		if(!active.connected) return;
+
+		const formData = new FormData(ev.target);
+
+		/** @type {PortForward} */
+		const fwd = {
+			type: formData.get('type'),
+			port: Number(formData.get('port')),
+			target: formData.get('target'),
+		};
+
+		sendSessionMsg(active, 'forward-add', JSON.stringify(fwd));
+		ev.target.reset();
+	});
+
+	sharingSet.querySelector('button[name="share"]').addEventListener('click', () => {
+		if(!active.connected) return;
+
+		sendSessionMsg(active, 'session-share');
+	});
+
+	sharingSet.querySelector('button[name="unshare"]').addEventListener('click', () => {
+		sendSessionMsg(active, 'session-unshare');
+
+		active.shareLink = undefined;
+		updateSharing(active);
+	});
+
+	nodeSet.querySelector('button[name="forget"]').addEventListener('click', () => {
+		if(tsWs?.readyState !== WebSocket.OPEN) return;
+		if(!confirm('Forget your node? It will be logged out, its sessions will end and you\'ll log in again on your next connection.')) return;
+
+		/** @type {WsMessage} */
+		const msg = {
+			type: 'node-forget',
+		};
+
+		tsWs.send(JSON.stringify(msg));
+	});
+
+	sharingSet.querySelector('button[name="copy"]').addEventListener('click', () => {
+		navigator.clipboard.writeText(active.shareLink);
+	});
 
 	inputFontSize.value = fontSize;
 	inputFontRange.value = fontSize;
@@ -432,21 +1548,26 @@ function initOptions() {
 		const size = inputFontSize.value;
 
 		inputFontRange.value = size;
-		term.options.fontSize = size;
-		
-		fitAddon.fit();
+		setFontSize(Number(size));
 	});
 
 	inputFontRange.addEventListener('input', () => {
 		const size = inputFontRange.value;
 
 		inputFontSize.value = size;
-		term.options.fontSize = size;
-
-		fitAddon.fit();
+		setFontSize(Number(size));
 	});
 }
 
+/**
+ * @param {Number} size
+ */
+function setFontSize(size) {
+	sessions.forEach((session) => session.term.options.fontSize = size);
+
+	active.fitAddon.fit();
+}
+
 function updateToggleScroll() {
 	const icon = (scrollVisible) ? icSideOpened : icSideClosed;
 	toggleScroll.innerHTML = icon;
@@ -457,47 +1578,25 @@ function updateToggleScroll() {
 // Add the GH logo into the footer link
 ghAnchor.innerHTML = `${ghLogo} ${ghAnchor.innerHTML}`;
 
-term.loadAddon(fitAddon);
-term.loadAddon(new WebLinksAddon());
-term.open(termContainer);
-fitAddon.fit();
+/** @type {Number} */
+let inputTid;
+let isDragging = false;
 
-// It should be safe to get the screen here after opening the terminal in the container
-const termScreen = termContainer.querySelector('.xterm-screen');
+showSession(createSession());
 
-/** @type {Number} */
-let tid;
+// The first session is configured from the init WebSocket
+dialogSession = active;
 
-term.onResize(({ rows, cols }) => {
-	clearTimeout(tid);
-	tid = setTimeout(() => onSize(), 500);
-});
+newTab.disabled = true;
+cancelConn.style.display = 'none';
 
 const rsObserver = new ResizeObserver(() => {
-	fitAddon.fit();
+	active.fitAddon.fit();
 });
 
 rsObserver.observe(termContainer);
 
-term.write('Welcome to \x1B[1;3;32mts-term\x1B[0m \r\n');
-
-term.onLineFeed(() => {
-	const thumbHeight = Math.round(term.rows / term.buffer.active.length * 100);
-
-	termView.style.setProperty('--slider-thumb-height', `clamp(2rem, ${thumbHeight}%, 100%)`);
-	slider.max = term.buffer.active.length;
-});
-
-/** @type {Number} */
-let inputTid;
-let isDragging = false;
-
-term.onScroll((n) => {
-	if(isDragging) return;
-
-	const pos = n / (term.buffer.active.length - term.rows) * term.buffer.active.length;
-	slider.value = pos;
-});
+active.term.write('Welcome to \x1B[1;3;32mts-term\x1B[0m \r\n');
 
 slider.addEventListener('input', () => {
 	clearTimeout(inputTid);
@@ -506,10 +1605,18 @@ slider.addEventListener('input', () => {
 	isDragging = true;
 
 	const pos = slider.value;
-	term.scrollToLine(pos);
+	active.term.scrollToLine(pos);
 });
 
 initMenu();
 initOptions();
+initFiles();
 initDialogs();
-connectInitWs();
+
+const pageParams = new URLSearchParams(location.search);
+
+if(pageParams.has('view')) {
+	connectViewWs(pageParams);
+} else {
+	connectInitWs();
+}
@@ -0,0 +1,264 @@
+import ghLogo from './brand-github.svg?raw';
+import { Terminal } from '@xterm/xterm';
+
+/**
+ * @typedef {Object} RecordingInfo
+ * @property {String} name
+ * @property {Number} size
+ * @property {String} started
+ * @property {String} session
+ * @property {String} user The Tailscale user who recorded the session.
+ * @property {String} node
+ * @property {String} host
+ */
+
+/**
+ * @typedef {Object} CastHeader
+ * @property {Number} version
+ * @property {Number} width
+ * @property {Number} height
+ * @property {Number} timestamp
+ */
+
+/**
+ * @typedef {Object} CastEvent
+ * @property {Number} time Seconds since the start of the recording.
+ * @property {String} code 'o' for output or 'r' for resize.
+ * @property {String} data
+ */
+
+/** @type {HTMLUListElement} */
+const recordingsList = document.querySelector('#recordings ul');
+
+/** @type {HTMLDivElement} */
+const termContainer = document.querySelector('#xterm-container');
+
+/** @type {HTMLButtonElement} */
+const playButton = document.querySelector('#player button[name="play"]');
+
+/** @type {HTMLInputElement} */
+const seekInput = document.querySelector('#player input[name="seek"]');
+
+/** @type {HTMLSelectElement} */
+const speedSelect = document.querySelector('#player select[name="speed"]');
+
+/** @type {HTMLSpanElement} */
+const timeLabel = document.querySelector('#player .time');
+
+/** @type {HTMLAnchorElement} */
+const ghAnchor = document.querySelector('#gh');
+
+const term = new Terminal({ disableStdin: true });
+
+/** @type {CastHeader} */
+let header;
+
+/** @type {Array<CastEvent>} */
+let events = [];
+
+let duration = 0;
+
+/** The playback position in seconds. */
+let position = 0;
+
+/** The index of the next event to play. */
+let eventIdx = 0;
+
+let playing = false;
+
+/** @type {Number} */
+let lastFrame;
+
+async function loadRecordings() {
+	/** @type {Array<RecordingInfo>} */
+	let infos;
+
+	try {
+		const resp = await fetch('/recordings');
+		if(!resp.ok) throw new Error(await resp.text());
+
+		infos = await resp.json();
+	} catch(err) {
+		console.log(err);
+		recordingsList.innerHTML = '<li>Unable to list the recordings.</li>';
+		return;
+	}
+
+	recordingsList.replaceChildren();
+
+	if(infos.length === 0) recordingsList.innerHTML = '<li>No recordings.</li>';
+
+	infos.forEach((info) => {
+		const item = document.createElement('li');
+		item.dataset.name = info.name;
+
+		const host = document.createElement('span');
+		host.className = 'host';
+		host.innerText = info.host;
+
+		const details = document.createElement('span');
+		details.className = 'details';
+		details.innerText = `${info.user} on ${info.node}, ${new Date(info.started).toLocaleString()}`;
+
+		item.append(host, details);
+		item.addEventListener('click', () => loadRecording(info.name));
+
+		recordingsList.append(item);
+	});
+}
+
+/**
+ * Fetches the recording and displays its start.
+ * @param {String} name
+ */
+async function loadRecording(name) {
+	pause();
+
+	recordingsList.querySelectorAll('li').forEach((item) => {
+		item.classList.toggle('selected', item.dataset.name === name);
+	});
+
+	const resp = await fetch(`/recordings/${encodeURIComponent(name)}`);
+
+	if(!resp.ok) {
+		header = undefined;
+		playButton.disabled = true;
+
+		term.reset();
+		term.write(`Unable to load ${name}. ${await resp.text()}`);
+		return;
+	}
+
+	const lines = (await resp.text()).split('\n').filter((line) => line.trim() !== '');
+
+	header = JSON.parse(lines[0]);
+
+	// A recording in progress may end with a partially written event
+	events = lines.slice(1)
+		.map((line) => {
+			try {
+				const [time, code, data] = JSON.parse(line);
+				return { time, code, data };
+			} catch {
+				return null;
+			}
+		})
+		.filter((event) => event && event.code !== 'i');
+
+	duration = events.at(-1)?.time ?? 0;
+
+	seekInput.max = duration;
+	playButton.disabled = false;
+
+	seek(0);
+}
+
+/**
+ * Redraws the terminal at the playback position.
+ * @param {Number} time
+ */
+function seek(time) {
+	if(!header) return;
+
+	term.reset();
+	term.resize(header.width, header.height);
+
+	position = time;
+	eventIdx = 0;
+
+	writeEvents(position);
+	updateTime();
+}
+
+/**
+ * Plays the events up to the time.
+ * @param {Number} until
+ */
+function writeEvents(until) {
+	let output = '';
+
+	while(eventIdx < events.length && events[eventIdx].time <= until) {
+		const { code, data } = events[eventIdx];
+
+		switch(code) {
+			case 'o':
+				output += data;
+				break;
+			case 'r':
+				term.write(output);
+				output = '';
+
+				const [cols, rows] = data.split('x').map(Number);
+				term.resize(cols, rows);
+				break;
+		}
+
+		eventIdx++;
+	}
+
+	if(output) term.write(output);
+}
+
+function play() {
+	if(!header) return;
+
+	if(position >= duration) seek(0);
+
+	playing = true;
+	playButton.innerText = 'Pause';
+
+	lastFrame = performance.now();
+	requestAnimationFrame(onFrame);
+}
+
+function pause() {
+	playing = false;
+	playButton.innerText = 'Play';
+}
+
+/**
+ * @param {DOMHighResTimeStamp} now
+ */
+function onFrame(now) {
+	if(!playing) return;
+
+	const elapsed = (now - lastFrame) / 1000 * Number(speedSelect.value);
+
+	position = Math.min(position + elapsed, duration);
+	lastFrame = now;
+
+	writeEvents(position);
+	updateTime();
+
+	if(position >= duration) {
+		pause();
+		return;
+	}
+
+	requestAnimationFrame(onFrame);
+}
+
+function updateTime() {
+	seekInput.value = position;
+	timeLabel.innerText = `${formatTime(position)} / ${formatTime(duration)}`;
+}
+
+/**
+ * @param {Number} secs
+ * @returns {String} ex. '1:05'
+ */
+function formatTime(secs) {
+	const mins = Math.floor(secs / 60);
+	const remainder = Math.floor(secs % 60).toString().padStart(2, '0');
+
+	return `${mins}:${remainder}`;
+}
+
+term.open(termContainer);
+
+playButton.addEventListener('click', () => (playing) ? pause() : play());
+seekInput.addEventListener('input', () => seek(Number(seekInput.value)));
+
+ghAnchor.innerHTML = `${ghLogo} ${ghAnchor.innerHTML}`;
+
+loadRecordings();
@@ -0,0 +1,13 @@
+import { resolve } from 'node:path';
+import { defineConfig } from 'vite';
+
+export default defineConfig({
+	build: {
+		rolldownOptions: {
+			input: {
+				main: resolve(import.meta.dirname, 'index.html'),
+				playback: resolve(import.meta.dirname, 'playback.html'),
+			},
+		},
+	},
+});